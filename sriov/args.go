@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/containernetworking/cni/pkg/types"
+)
+
+// PodArgs are the CNI_ARGS understood by the plugin. The K8S_* keys are
+// set by the kubelet; MAC, IP and VLAN override the network config for
+// a single pod. MAC and IP take a comma separated list whose n-th entry
+// applies to the pod interface ethN. NUMA_NODES carries the NUMA nodes
+// of the Topology Manager hint of the pod.
+type PodArgs struct {
+	types.CommonArgs
+	K8S_POD_NAMESPACE          stringArg
+	K8S_POD_NAME               stringArg
+	K8S_POD_UID                stringArg
+	K8S_POD_INFRA_CONTAINER_ID stringArg
+	MAC                        macListArg
+	IP                         ipListArg
+	VLAN                       vlanArg
+	NUMA_NODES                 numaListArg
+}
+
+type stringArg string
+
+func (s *stringArg) UnmarshalText(data []byte) error {
+	*s = stringArg(data)
+	return nil
+}
+
+type macListArg []net.HardwareAddr
+
+func (m *macListArg) UnmarshalText(data []byte) error {
+	for _, field := range strings.Split(string(data), ",") {
+		mac, err := net.ParseMAC(field)
+		if err != nil {
+			return fmt.Errorf("invalid MAC address %q: %v", field, err)
+		}
+		*m = append(*m, mac)
+	}
+	return nil
+}
+
+// get returns the MAC for the i-th pod interface, or nil if none was given.
+func (m macListArg) get(i int) net.HardwareAddr {
+	if i < len(m) {
+		return m[i]
+	}
+	return nil
+}
+
+type ipListArg []net.IP
+
+func (l *ipListArg) UnmarshalText(data []byte) error {
+	for _, field := range strings.Split(string(data), ",") {
+		ip := net.ParseIP(field)
+		if ip == nil {
+			return fmt.Errorf("invalid IP address %q", field)
+		}
+		*l = append(*l, ip)
+	}
+	return nil
+}
+
+// get returns the IP for the i-th pod interface, or nil if none was given.
+func (l ipListArg) get(i int) net.IP {
+	if i < len(l) {
+		return l[i]
+	}
+	return nil
+}
+
+type vlanArg struct {
+	set   bool
+	value int
+}
+
+func (v *vlanArg) UnmarshalText(data []byte) error {
+	vlan, err := strconv.Atoi(string(data))
+	if err != nil || vlan < 0 || vlan > 4094 {
+		return fmt.Errorf("invalid VLAN %q, expected an integer between 0 and 4094", string(data))
+	}
+	v.set = true
+	v.value = vlan
+	return nil
+}
+
+type numaListArg []int
+
+func (l *numaListArg) UnmarshalText(data []byte) error {
+	for _, field := range strings.Split(string(data), ",") {
+		node, err := strconv.Atoi(field)
+		if err != nil || node < 0 {
+			return fmt.Errorf("invalid NUMA node %q", field)
+		}
+		*l = append(*l, node)
+	}
+	return nil
+}
+
+func loadPodArgs(args string) (*PodArgs, error) {
+	podArgs := &PodArgs{}
+	// runtimes also pass keys that are meant for other plugins
+	podArgs.IgnoreUnknown = true
+
+	if err := types.LoadArgs(args, podArgs); err != nil {
+		return nil, newError(errCodeInvalidArgs, "invalid CNI_ARGS", "%v", err)
+	}
+
+	return podArgs, nil
+}
+
+// ipamArgs returns the CNI_ARGS for the IPAM plugin of one pod interface:
+// the plugin's own args with IP replaced by the address requested for
+// that interface.
+func ipamArgs(args string, ip net.IP) string {
+	var pairs []string
+	for _, pair := range strings.Split(args, ";") {
+		if pair == "" || strings.HasPrefix(pair, "IP=") {
+			continue
+		}
+		pairs = append(pairs, pair)
+	}
+	if ip != nil {
+		pairs = append(pairs, "IP="+ip.String())
+	}
+	return strings.Join(pairs, ";")
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/containernetworking/cni/pkg/types"
+)
+
+func TestLoadPodArgs(t *testing.T) {
+	podArgs, err := loadPodArgs("IgnoreUnknown=1;K8S_POD_NAMESPACE=default;K8S_POD_NAME=web-0;" +
+		"MAC=66:77:88:99:aa:bb,66:77:88:99:aa:cc;IP=10.0.0.2,fd00::2;VLAN=100;NUMA_NODES=0,1;OTHER=x")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if podArgs.K8S_POD_NAMESPACE != "default" || podArgs.K8S_POD_NAME != "web-0" {
+		t.Errorf("pod is %s/%s, want default/web-0", podArgs.K8S_POD_NAMESPACE, podArgs.K8S_POD_NAME)
+	}
+	if mac := podArgs.MAC.get(1); mac.String() != "66:77:88:99:aa:cc" {
+		t.Errorf("MAC of eth1 is %v", mac)
+	}
+	if mac := podArgs.MAC.get(2); mac != nil {
+		t.Errorf("MAC of eth2 is %v, want none", mac)
+	}
+	if ip := podArgs.IP.get(1); !ip.Equal(net.ParseIP("fd00::2")) {
+		t.Errorf("IP of eth1 is %v", ip)
+	}
+	if ip := podArgs.IP.get(2); ip != nil {
+		t.Errorf("IP of eth2 is %v, want none", ip)
+	}
+	if podArgs.VLAN != (vlanArg{set: true, value: 100}) {
+		t.Errorf("VLAN is %+v", podArgs.VLAN)
+	}
+	if !reflect.DeepEqual(podArgs.NUMA_NODES, numaListArg{0, 1}) {
+		t.Errorf("NUMA nodes are %v", podArgs.NUMA_NODES)
+	}
+
+	podArgs, err = loadPodArgs("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if podArgs.MAC.get(0) != nil || podArgs.IP.get(0) != nil || podArgs.VLAN.set || len(podArgs.NUMA_NODES) != 0 {
+		t.Errorf("empty CNI_ARGS set overrides: %+v", podArgs)
+	}
+}
+
+func TestLoadPodArgsInvalid(t *testing.T) {
+	for _, args := range []string{
+		"MAC=66:77:88:99:aa",
+		"MAC=66:77:88:99:aa:bb,",
+		"IP=10.0.0.256",
+		"VLAN=4095",
+		"VLAN=-1",
+		"VLAN=ten",
+		"NUMA_NODES=0,-1",
+		"NUMA_NODES=a",
+	} {
+		_, err := loadPodArgs(args)
+		if cniErr, ok := err.(*types.Error); !ok || cniErr.Code != errCodeInvalidArgs {
+			t.Errorf("%s: error %v, want code %d", args, err, errCodeInvalidArgs)
+		}
+	}
+}
+
+func TestIpamArgs(t *testing.T) {
+	cases := []struct {
+		args string
+		ip   net.IP
+		want string
+	}{
+		{"", nil, ""},
+		{"K8S_POD_NAME=web-0", nil, "K8S_POD_NAME=web-0"},
+		{"K8S_POD_NAME=web-0", net.ParseIP("10.0.0.2"), "K8S_POD_NAME=web-0;IP=10.0.0.2"},
+		{"IP=10.0.0.2,10.0.0.3;K8S_POD_NAME=web-0", net.ParseIP("10.0.0.3"), "K8S_POD_NAME=web-0;IP=10.0.0.3"},
+		{"IP=10.0.0.2,10.0.0.3;K8S_POD_NAME=web-0", nil, "K8S_POD_NAME=web-0"},
+	}
+	for _, c := range cases {
+		if got := ipamArgs(c.args, c.ip); got != c.want {
+			t.Errorf("ipamArgs(%q, %v) = %q, want %q", c.args, c.ip, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/rit-k8s-rdma/rit-k8s-rdma-sriov-cni/sriov/placement"
+)
+
+// RuntimeConfig holds the values the runtime passes for the mac, ips,
+// bandwidth and deviceID capabilities declared in the network config.
+type RuntimeConfig struct {
+	Mac       string          `json:"mac,omitempty"`
+	IPs       []string        `json:"ips,omitempty"`
+	Bandwidth *BandwidthEntry `json:"bandwidth,omitempty"`
+	DeviceID  string          `json:"deviceID,omitempty"`
+}
+
+// BandwidthEntry follows the bandwidth capability convention; rates are
+// in bits per second.
+type BandwidthEntry struct {
+	IngressRate  uint64 `json:"ingressRate"`
+	IngressBurst uint64 `json:"ingressBurst"`
+	EgressRate   uint64 `json:"egressRate"`
+	EgressBurst  uint64 `json:"egressBurst"`
+}
+
+// applyRuntimeConfig merges the capability values into the per-pod
+// overrides. Values given in CNI_ARGS take precedence; mac and deviceID
+// apply to the first pod interface.
+func applyRuntimeConfig(n *NetConf, podArgs *PodArgs) error {
+	rc := n.RuntimeConfig
+
+	if rc.Mac != "" && podArgs.MAC.get(0) == nil {
+		mac, err := net.ParseMAC(rc.Mac)
+		if err != nil {
+			return newError(errCodeInvalidRuntimeConfig, "invalid runtimeConfig",
+				"invalid mac %q: %v", rc.Mac, err)
+		}
+		podArgs.MAC = append(macListArg{mac}, podArgs.MAC...)
+	}
+
+	if len(rc.IPs) > 0 && len(podArgs.IP) == 0 {
+		for _, cidr := range rc.IPs {
+			ip, _, err := net.ParseCIDR(cidr)
+			if err != nil {
+				if ip = net.ParseIP(cidr); ip == nil {
+					return newError(errCodeInvalidRuntimeConfig, "invalid runtimeConfig",
+						"invalid ips entry %q: %v", cidr, err)
+				}
+			}
+			podArgs.IP = append(podArgs.IP, ip)
+		}
+	}
+
+	return nil
+}
+
+// applyBandwidth caps the max tx rate of every requested interface with
+// the egress rate of the bandwidth capability. VF rates are in Mbps; the
+// ingress rate cannot be enforced on a VF and is ignored.
+func applyBandwidth(requests []placement.Request, bandwidth *BandwidthEntry) error {
+	if bandwidth == nil || bandwidth.EgressRate == 0 {
+		return nil
+	}
+
+	rate := uint(bandwidth.EgressRate / 1000000)
+	if rate == 0 {
+		rate = 1
+	}
+
+	for i := range requests {
+		if requests[i].MaxTxRate == 0 || requests[i].MaxTxRate > rate {
+			requests[i].MaxTxRate = rate
+		}
+		if requests[i].MinTxRate > requests[i].MaxTxRate {
+			return newError(errCodeInvalidRuntimeConfig, "invalid runtimeConfig",
+				"egress rate of %d Mbps is below the min_tx_rate of %d Mbps requested for eth%d",
+				rate, requests[i].MinTxRate, i)
+		}
+	}
+
+	return nil
+}
+
+// getVfByPciAddress returns the PF netdev name and the VF index of the VF
+// with the given PCI address, as handed out through deviceID.
+func getVfByPciAddress(pciAddr string) (string, int, error) {
+	deviceDir := filepath.Join(sysBusPciDir, "devices", pciAddr)
+	physfn, err := os.Readlink(filepath.Join(deviceDir, "physfn"))
+	if err != nil {
+		return "", -1, fmt.Errorf("device %q is not a VF: %v", pciAddr, err)
+	}
+
+	pfNetdevs, err := pciNetDevices(filepath.Base(physfn))
+	if err != nil {
+		return "", -1, err
+	}
+	if len(pfNetdevs) == 0 {
+		return "", -1, fmt.Errorf("no netdev found for PF of device %q", pciAddr)
+	}
+
+	virtfns, err := filepath.Glob(filepath.Join(deviceDir, "physfn", "virtfn*"))
+	if err != nil {
+		return "", -1, err
+	}
+	for _, virtfn := range virtfns {
+		vf, err := os.Readlink(virtfn)
+		if err != nil || filepath.Base(vf) != pciAddr {
+			continue
+		}
+		if vfIdx, err := strconv.Atoi(strings.TrimPrefix(filepath.Base(virtfn), "virtfn")); err == nil {
+			return pfNetdevs[0], vfIdx, nil
+		}
+	}
+
+	return "", -1, fmt.Errorf("vf index of device %q not found", pciAddr)
+}
+
+// getPfByPciAddress returns the netdev name of the PF with the given PCI
+// address.
+func getPfByPciAddress(pciAddr string) (string, error) {
+	if _, err := os.Stat(filepath.Join(sysBusPciDir, "devices", pciAddr)); err != nil {
+		return "", fmt.Errorf("device %q not found: %v", pciAddr, err)
+	}
+
+	pfNetdevs, err := pciNetDevices(pciAddr)
+	if err != nil {
+		return "", err
+	}
+	if len(pfNetdevs) == 0 {
+		return "", fmt.Errorf("no netdev found for device %q", pciAddr)
+	}
+
+	return pfNetdevs[0], nil
+}
+
+// pciNetDevices returns the names of the netdevs of a PCI device, in
+// name order.
+func pciNetDevices(pciAddr string) ([]string, error) {
+	infos, err := ioutil.ReadDir(filepath.Join(sysBusPciDir, "devices", pciAddr, "net"))
+	if err != nil {
+		return nil, fmt.Errorf("cannot get a network device with pci address %v: %v", pciAddr, err)
+	}
+
+	names := make([]string, len(infos))
+	for i, info := range infos {
+		names[i] = info.Name()
+	}
+	return names, nil
+}
+
+// applyDeviceID pins the first pod interface to the VF handed out through
+// deviceID.
+func applyDeviceID(requests []placement.Request, deviceID string) error {
+	if deviceID == "" || len(requests) == 0 {
+		return nil
+	}
+
+	if _, _, err := getVfByPciAddress(deviceID); err != nil {
+		return newError(errCodeInvalidRuntimeConfig, "invalid runtimeConfig",
+			"invalid deviceID %q: %v", deviceID, err)
+	}
+	if requests[0].PCIAddress != "" && requests[0].PCIAddress != deviceID {
+		return newError(errCodeInvalidRuntimeConfig, "invalid runtimeConfig",
+			"deviceID %q conflicts with pci_address %q requested for eth0", deviceID, requests[0].PCIAddress)
+	}
+	requests[0].PCIAddress = deviceID
+
+	return nil
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/containernetworking/cni/pkg/types"
+
+	"github.com/rit-k8s-rdma/rit-k8s-rdma-sriov-cni/sriov/placement"
+)
+
+func TestApplyRuntimeConfig(t *testing.T) {
+	cases := []struct {
+		name    string
+		args    string
+		runtime RuntimeConfig
+		macs    []string
+		ips     []string
+	}{
+		{
+			name: "nothing given",
+		},
+		{
+			name:    "runtime values only",
+			runtime: RuntimeConfig{Mac: "66:77:88:99:aa:bb", IPs: []string{"10.0.0.2/24", "fd00::2"}},
+			macs:    []string{"66:77:88:99:aa:bb"},
+			ips:     []string{"10.0.0.2", "fd00::2"},
+		},
+		{
+			name:    "CNI_ARGS take precedence",
+			args:    "MAC=66:77:88:99:aa:cc;IP=10.0.0.3",
+			runtime: RuntimeConfig{Mac: "66:77:88:99:aa:bb", IPs: []string{"10.0.0.2/24"}},
+			macs:    []string{"66:77:88:99:aa:cc"},
+			ips:     []string{"10.0.0.3"},
+		},
+		{
+			name:    "runtime mac with CNI_ARGS addresses",
+			args:    "IP=10.0.0.3",
+			runtime: RuntimeConfig{Mac: "66:77:88:99:aa:bb", IPs: []string{"10.0.0.2/24"}},
+			macs:    []string{"66:77:88:99:aa:bb"},
+			ips:     []string{"10.0.0.3"},
+		},
+	}
+
+	for _, c := range cases {
+		podArgs, err := loadPodArgs(c.args)
+		if err != nil {
+			t.Fatal(err)
+		}
+		n := &NetConf{RuntimeConfig: c.runtime}
+		if err = applyRuntimeConfig(n, podArgs); err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+
+		var macs, ips []string
+		for _, mac := range podArgs.MAC {
+			macs = append(macs, mac.String())
+		}
+		for _, ip := range podArgs.IP {
+			ips = append(ips, ip.String())
+		}
+		if !reflect.DeepEqual(macs, c.macs) || !reflect.DeepEqual(ips, c.ips) {
+			t.Errorf("%s: macs %v ips %v, want %v %v", c.name, macs, ips, c.macs, c.ips)
+		}
+	}
+}
+
+func TestApplyRuntimeConfigInvalid(t *testing.T) {
+	for _, rc := range []RuntimeConfig{
+		{Mac: "66:77:88:99:aa"},
+		{IPs: []string{"10.0.0.2/24", "10.0.0.256"}},
+	} {
+		podArgs, err := loadPodArgs("")
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = applyRuntimeConfig(&NetConf{RuntimeConfig: rc}, podArgs)
+		if cniErr, ok := err.(*types.Error); !ok || cniErr.Code != errCodeInvalidRuntimeConfig {
+			t.Errorf("%+v: error %v, want code %d", rc, err, errCodeInvalidRuntimeConfig)
+		}
+	}
+}
+
+func testRequests(rates ...[2]uint) []placement.Request {
+	requests := make([]placement.Request, len(rates))
+	for i, r := range rates {
+		requests[i].MinTxRate = r[0]
+		requests[i].MaxTxRate = r[1]
+	}
+	return requests
+}
+
+func TestApplyBandwidth(t *testing.T) {
+	cases := []struct {
+		name      string
+		bandwidth *BandwidthEntry
+		requests  []placement.Request
+		maxRates  []uint
+		errorCode uint
+	}{
+		{
+			name:     "no bandwidth capability",
+			requests: testRequests([2]uint{0, 0}, [2]uint{0, 2000}),
+			maxRates: []uint{0, 2000},
+		},
+		{
+			name:      "zero egress rate",
+			bandwidth: &BandwidthEntry{IngressRate: 1000000000},
+			requests:  testRequests([2]uint{0, 0}, [2]uint{0, 2000}),
+			maxRates:  []uint{0, 2000},
+		},
+		{
+			name:      "egress rate in Mbps",
+			bandwidth: &BandwidthEntry{EgressRate: 1000000000},
+			requests:  testRequests([2]uint{0, 0}),
+			maxRates:  []uint{1000},
+		},
+		{
+			name:      "rounded down to whole Mbps",
+			bandwidth: &BandwidthEntry{EgressRate: 1999999},
+			requests:  testRequests([2]uint{0, 0}),
+			maxRates:  []uint{1},
+		},
+		{
+			name:      "below 1 Mbps",
+			bandwidth: &BandwidthEntry{EgressRate: 999},
+			requests:  testRequests([2]uint{0, 0}),
+			maxRates:  []uint{1},
+		},
+		{
+			name:      "lower than an explicit max tx rate",
+			bandwidth: &BandwidthEntry{EgressRate: 500000000},
+			requests:  testRequests([2]uint{0, 2000}, [2]uint{100, 300}),
+			maxRates:  []uint{500, 300},
+		},
+		{
+			name:      "lower than the min tx rate",
+			bandwidth: &BandwidthEntry{EgressRate: 500000000},
+			requests:  testRequests([2]uint{0, 0}, [2]uint{1000, 2000}),
+			errorCode: errCodeInvalidRuntimeConfig,
+		},
+	}
+
+	for _, c := range cases {
+		err := applyBandwidth(c.requests, c.bandwidth)
+		if c.errorCode != 0 {
+			if cniErr, ok := err.(*types.Error); !ok || cniErr.Code != c.errorCode {
+				t.Errorf("%s: error %v, want code %d", c.name, err, c.errorCode)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+		var maxRates []uint
+		for _, r := range c.requests {
+			maxRates = append(maxRates, r.MaxTxRate)
+		}
+		if !reflect.DeepEqual(maxRates, c.maxRates) {
+			t.Errorf("%s: max tx rates %v, want %v", c.name, maxRates, c.maxRates)
+		}
+	}
+}
+
+func TestApplyDeviceID(t *testing.T) {
+	defer withPciDevices(t, 2)()
+
+	requests := testRequests([2]uint{0, 0}, [2]uint{0, 0})
+	if err := applyDeviceID(requests, "0000:03:00.2"); err != nil {
+		t.Fatal(err)
+	}
+	if requests[0].PCIAddress != "0000:03:00.2" || requests[1].PCIAddress != "" {
+		t.Errorf("pinned %q %q, want the first interface only", requests[0].PCIAddress, requests[1].PCIAddress)
+	}
+
+	for _, deviceID := range []string{"0000:03:00.0", "0000:81:00.1"} {
+		err := applyDeviceID(testRequests([2]uint{0, 0}), deviceID)
+		if cniErr, ok := err.(*types.Error); !ok || cniErr.Code != errCodeInvalidRuntimeConfig {
+			t.Errorf("%s: error %v, want code %d", deviceID, err, errCodeInvalidRuntimeConfig)
+		}
+	}
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+
+	"github.com/rit-k8s-rdma/rit-k8s-rdma-common/rdma_hardware_info"
+	types040 "github.com/rit-k8s-rdma/rit-k8s-rdma-sriov-cni/sriov/cni/types"
+	"github.com/rit-k8s-rdma/rit-k8s-rdma-sriov-cni/sriov/cni/types/current"
+
+	"github.com/containernetworking/cni/pkg/ns"
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/vishvananda/netlink"
+)
+
+func driftErr(ifName string, format string, args ...interface{}) *types.Error {
+	return newError(errCodeInterfaceDrift,
+		fmt.Sprintf("pod interface %q has drifted from its configuration", ifName),
+		format, args...)
+}
+
+// checkMain mirrors skel.PluginMain for the CHECK command, which the
+// vendored skel does not support.
+func checkMain(cmdCheck func(_ *skel.CmdArgs) error) {
+	cmdArgs := &skel.CmdArgs{
+		ContainerID: os.Getenv("CNI_CONTAINERID"),
+		Netns:       os.Getenv("CNI_NETNS"),
+		IfName:      os.Getenv("CNI_IFNAME"),
+		Args:        os.Getenv("CNI_ARGS"),
+		Path:        os.Getenv("CNI_PATH"),
+	}
+
+	argsMissing := false
+	for name, val := range map[string]string{
+		"CNI_CONTAINERID": cmdArgs.ContainerID,
+		"CNI_NETNS":       cmdArgs.Netns,
+		"CNI_IFNAME":      cmdArgs.IfName,
+		"CNI_PATH":        cmdArgs.Path,
+	} {
+		if val == "" {
+			log.Printf("%v env variable missing", name)
+			argsMissing = true
+		}
+	}
+	if argsMissing {
+		dieErr(&types.Error{Code: 100, Msg: "required env variables missing"})
+	}
+
+	stdinData, err := ioutil.ReadAll(os.Stdin)
+	if err != nil {
+		dieErr(&types.Error{Code: 100, Msg: fmt.Sprintf("error reading from stdin: %v", err)})
+	}
+	cmdArgs.StdinData = stdinData
+
+	if err = cmdCheck(cmdArgs); err != nil {
+		if e, ok := err.(*types.Error); ok {
+			dieErr(e)
+		}
+		dieErr(&types.Error{Code: 100, Msg: err.Error()})
+	}
+}
+
+func dieErr(e *types.Error) {
+	if err := e.Print(); err != nil {
+		log.Print("Error writing error JSON to stdout: ", err)
+	}
+	os.Exit(1)
+}
+
+func cmdCheck(args *skel.CmdArgs) error {
+	log.Println("RIT-CNI: CMDCHECK")
+
+	n, err := loadConf(args.StdinData)
+	if err != nil {
+		return err
+	}
+
+	if !versionAtLeast(n.CNIVersion, "0.4.0") {
+		return &types.Error{
+			Code:    types040.ErrIncompatibleCNIVersion,
+			Msg:     "CHECK is not supported by this config version",
+			Details: fmt.Sprintf("config is %q, CHECK requires 0.4.0 or later", n.CNIVersion),
+		}
+	}
+
+	// CHECK is only meaningful against the result of ADD
+	if n.PrevResult == nil {
+		return fmt.Errorf("required prevResult missing")
+	}
+	prevResult, err := current.GetResult(n.PrevResult)
+	if err != nil {
+		return fmt.Errorf("failed to convert prevResult: %v", err)
+	}
+
+	netns, err := ns.GetNS(args.Netns)
+	if err != nil {
+		return fmt.Errorf("failed to open netns %q: %v", args.Netns, err)
+	}
+	defer netns.Close()
+
+	savedConfs, err := getSavedNetConfs(args.ContainerID, n.CNIDir)
+	if err != nil {
+		return err
+	}
+	if err = checkRecorded(prevResult, savedConfs); err != nil {
+		return err
+	}
+
+	// the pod may legitimately have no RDMA interfaces
+	if len(savedConfs) > 0 {
+		pfs, err := queryNodePFs()
+		if err != nil {
+			return newError(errCodeHardwareDaemonUnreachable, "RDMA hardware daemon unreachable", "%v", err)
+		}
+		for _, saved := range savedConfs {
+			if err = checkVF(saved, netns, pfs); err != nil {
+				return err
+			}
+		}
+	}
+
+	return checkAddresses(prevResult, netns)
+}
+
+// checkRecorded verifies that every interface of the previous result is
+// one that cmdAdd saved a netconf for, the shared d1 netdev of a VF
+// included.
+func checkRecorded(prevResult *current.Result, savedConfs []*NetConf) error {
+	recorded := make(map[string]bool)
+	for _, saved := range savedConfs {
+		recorded[saved.DPDKConf.Ifname] = true
+		if saved.Sharedvf {
+			recorded[saved.DPDKConf.Ifname+"d1"] = true
+		}
+	}
+
+	for _, intf := range prevResult.Interfaces {
+		if !recorded[intf.Name] {
+			return driftErr(intf.Name, "interface of the previous result was not set up by this plugin")
+		}
+	}
+	return nil
+}
+
+// checkVF verifies that the VF saved for one pod interface, with its
+// shared netdev if it has one, is still in place and still carries the VLAN and rates that cmdAdd programmed.
+func checkVF(saved *NetConf, netns ns.NetNS, pfs []rdma_hardware_info.PF) error {
+	ifName := saved.DPDKConf.Ifname
+
+	if saved.DPDKMode {
+		driver, err := getPciDriver(saved.DPDKConf.PCIaddr)
+		if err != nil {
+			return driftErr(ifName, "%v", err)
+		}
+		if driver != saved.DPDKConf.DPDKDriver {
+			return driftErr(ifName, "VF %s is bound to %q, expected %q",
+				saved.DPDKConf.PCIaddr, driver, saved.DPDKConf.DPDKDriver)
+		}
+		if saved.DPDKConf.VFIODevice != "" {
+			if _, err = os.Stat(saved.DPDKConf.VFIODevice); err != nil {
+				return driftErr(ifName, "vfio device of VF %s is gone: %v", saved.DPDKConf.PCIaddr, err)
+			}
+		}
+	} else {
+		ifNames := []string{ifName}
+		if saved.Sharedvf {
+			ifNames = append(ifNames, ifName+"d1")
+		}
+		for _, name := range ifNames {
+			err := netns.Do(func(_ ns.NetNS) error {
+				_, err := netlink.LinkByName(name)
+				return err
+			})
+			if err != nil {
+				return driftErr(name, "interface not found in netns %q: %v", netns.Path(), err)
+			}
+		}
+	}
+
+	var vf *rdma_hardware_info.VF
+	for _, pf := range pfs {
+		if pf.Name != saved.PFName {
+			continue
+		}
+		for _, candidate := range pf.VFs {
+			if int(candidate.VFNumber) == saved.DPDKConf.VFID {
+				vf = candidate
+				break
+			}
+		}
+	}
+	if vf == nil {
+		return driftErr(ifName, "VF %d no longer exists on PF %q", saved.DPDKConf.VFID, saved.PFName)
+	}
+
+	if vf.VLAN != uint(saved.Vlan) {
+		return driftErr(ifName, "VF %d on PF %q has vlan %d, expected %d",
+			vf.VFNumber, saved.PFName, vf.VLAN, saved.Vlan)
+	}
+	if vf.MinTxRate != saved.MinTxRate || vf.MaxTxRate != saved.MaxTxRate {
+		return driftErr(ifName, "VF %d on PF %q has min/max tx rate %d/%d, expected %d/%d",
+			vf.VFNumber, saved.PFName, vf.MinTxRate, vf.MaxTxRate, saved.MinTxRate, saved.MaxTxRate)
+	}
+
+	return nil
+}
+
+// checkAddresses verifies that every IP of the previous result is still
+// assigned inside the pod netns.
+func checkAddresses(prevResult *current.Result, netns ns.NetNS) error {
+	return netns.Do(func(_ ns.NetNS) error {
+		for _, ipc := range prevResult.IPs {
+			links, err := ipConfigLinks(prevResult, ipc)
+			if err != nil {
+				return err
+			}
+
+			found := false
+			for _, link := range links {
+				addrs, err := netlink.AddrList(link, netlink.FAMILY_ALL)
+				if err != nil {
+					return fmt.Errorf("failed to list addresses of %q: %v", link.Attrs().Name, err)
+				}
+				for _, addr := range addrs {
+					if addr.IPNet.IP.Equal(ipc.Address.IP) &&
+						net.IP(addr.IPNet.Mask).Equal(net.IP(ipc.Address.Mask)) {
+						found = true
+						break
+					}
+				}
+			}
+
+			if !found {
+				ifName := "eth*"
+				if len(links) == 1 {
+					ifName = links[0].Attrs().Name
+				}
+				return driftErr(ifName, "address %s is no longer assigned", ipc.Address.String())
+			}
+		}
+		return nil
+	})
+}
+
+// ipConfigLinks returns the links an IP of the previous result may live
+// on: the interface it references, or every ethN link when it has none.
+func ipConfigLinks(prevResult *current.Result, ipc *current.IPConfig) ([]netlink.Link, error) {
+	if ipc.Interface != nil && *ipc.Interface >= 0 && *ipc.Interface < len(prevResult.Interfaces) {
+		ifName := prevResult.Interfaces[*ipc.Interface].Name
+		link, err := netlink.LinkByName(ifName)
+		if err != nil {
+			return nil, driftErr(ifName, "interface not found: %v", err)
+		}
+		return []netlink.Link{link}, nil
+	}
+
+	all, err := netlink.LinkList()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list links: %v", err)
+	}
+
+	var links []netlink.Link
+	for _, link := range all {
+		if isPodVFName(link.Attrs().Name) {
+			links = append(links, link)
+		}
+	}
+	return links, nil
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/containernetworking/cni/pkg/ns"
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/rit-k8s-rdma/rit-k8s-rdma-common/rdma_hardware_info"
+	"github.com/vishvananda/netlink"
+
+	types040 "github.com/rit-k8s-rdma/rit-k8s-rdma-sriov-cni/sriov/cni/types"
+	"github.com/rit-k8s-rdma/rit-k8s-rdma-sriov-cni/sriov/cni/types/current"
+)
+
+// testNetns creates a netns holding a bridge, which stands in for a VF
+// netdev, for every link name with the given addresses assigned. It
+// needs CAP_NET_ADMIN, the test is skipped without it.
+func testNetns(t *testing.T, links map[string][]string) ns.NetNS {
+	if os.Geteuid() != 0 {
+		t.Skip("creating a netns needs root")
+	}
+
+	netns, err := ns.NewNS()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = netns.Do(func(_ ns.NetNS) error {
+		for name, addrs := range links {
+			link := &netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: name}}
+			if err := netlink.LinkAdd(link); err != nil {
+				return fmt.Errorf("adding %s: %v", name, err)
+			}
+			for _, a := range addrs {
+				addr, err := netlink.ParseAddr(a)
+				if err != nil {
+					return err
+				}
+				if err = netlink.AddrAdd(link, addr); err != nil {
+					return fmt.Errorf("adding %s to %s: %v", a, name, err)
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		netns.Close()
+		t.Fatal(err)
+	}
+	return netns
+}
+
+func testResult(interfaces []string, addrs map[string]int) *current.Result {
+	res := &current.Result{CNIVersion: "0.4.0"}
+	for _, name := range interfaces {
+		res.Interfaces = append(res.Interfaces, &current.Interface{Name: name})
+	}
+	for a, intf := range addrs {
+		ip, ipnet, err := net.ParseCIDR(a)
+		if err != nil {
+			panic(err)
+		}
+		ipnet.IP = ip
+		ipc := &current.IPConfig{Version: "4", Address: *ipnet}
+		if intf >= 0 {
+			ipc.Interface = current.Int(intf)
+		}
+		res.IPs = append(res.IPs, ipc)
+	}
+	return res
+}
+
+func wantCode(err error, code uint) bool {
+	cniErr, ok := err.(*types.Error)
+	return ok && cniErr.Code == code
+}
+
+func TestCheckRecorded(t *testing.T) {
+	shared := &NetConf{Sharedvf: true}
+	shared.DPDKConf.Ifname = "eth1"
+	saved := []*NetConf{savedTestNetConf("c1", "eth0", "0000:03:00.2", false).conf, shared}
+
+	cases := []struct {
+		interfaces []string
+		drifted    bool
+	}{
+		{interfaces: nil},
+		{interfaces: []string{"eth0", "eth1", "eth1d1"}},
+		{interfaces: []string{"eth0", "eth2"}, drifted: true},
+		{interfaces: []string{"eth0d1"}, drifted: true},
+	}
+	for _, c := range cases {
+		err := checkRecorded(testResult(c.interfaces, nil), saved)
+		if c.drifted != wantCode(err, errCodeInterfaceDrift) || (!c.drifted && err != nil) {
+			t.Errorf("%v: error %v, want drift %v", c.interfaces, err, c.drifted)
+		}
+	}
+}
+
+func TestCheckAddresses(t *testing.T) {
+	netns := testNetns(t, map[string][]string{
+		"eth0": {"10.0.0.2/24"},
+		"eth1": {"10.0.1.2/24"},
+	})
+	defer netns.Close()
+
+	cases := []struct {
+		name       string
+		interfaces []string
+		addrs      map[string]int
+		drifted    bool
+	}{
+		{name: "no addresses"},
+		{
+			name:       "addresses on their interfaces",
+			interfaces: []string{"eth0", "eth1"},
+			addrs:      map[string]int{"10.0.0.2/24": 0, "10.0.1.2/24": 1},
+		},
+		{
+			name:  "address without interface",
+			addrs: map[string]int{"10.0.1.2/24": -1},
+		},
+		{
+			name:       "address on another interface",
+			interfaces: []string{"eth0", "eth1"},
+			addrs:      map[string]int{"10.0.1.2/24": 0},
+			drifted:    true,
+		},
+		{
+			name:    "address with another mask",
+			addrs:   map[string]int{"10.0.0.2/16": -1},
+			drifted: true,
+		},
+		{
+			name:       "missing interface",
+			interfaces: []string{"eth2"},
+			addrs:      map[string]int{"10.0.0.2/24": 0},
+			drifted:    true,
+		},
+	}
+	for _, c := range cases {
+		err := checkAddresses(testResult(c.interfaces, c.addrs), netns)
+		if c.drifted != wantCode(err, errCodeInterfaceDrift) || (!c.drifted && err != nil) {
+			t.Errorf("%s: error %v, want drift %v", c.name, err, c.drifted)
+		}
+	}
+}
+
+func TestCmdCheck(t *testing.T) {
+	netns := testNetns(t, map[string][]string{
+		"eth0": {"10.0.0.2/24"},
+		"eth1": nil,
+	})
+	defer netns.Close()
+
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	orig := queryNodePFs
+	defer func() { queryNodePFs = orig }()
+	vlan := uint(100)
+	queryNodePFs = func() ([]rdma_hardware_info.PF, error) {
+		return []rdma_hardware_info.PF{{Name: "ens1f0", VFs: []*rdma_hardware_info.VF{
+			{VFNumber: 1, VLAN: vlan, MaxTxRate: 2000},
+			{VFNumber: 2},
+		}}}, nil
+	}
+
+	eth0 := &NetConf{PFName: "ens1f0", Vlan: 100, MaxTxRate: 2000}
+	eth0.DPDKConf = dpdkConf{PCIaddr: "0000:03:00.2", Ifname: "eth0", VFID: 1}
+	eth1 := &NetConf{PFName: "ens1f0", Sharedvf: true}
+	eth1.DPDKConf = dpdkConf{PCIaddr: "0000:03:00.3", Ifname: "eth1", VFID: 2}
+
+	prevResult := `{"cniVersion":"0.4.0","interfaces":[{"name":"eth0"}],` +
+		`"ips":[{"version":"4","address":"10.0.0.2/24","interface":0}]}`
+	stdin := func(version, prevResult string) []byte {
+		conf := fmt.Sprintf(`{"cniVersion":%q,"name":"mynet","type":"sriov","cniDir":%q`, version, dir)
+		if prevResult != "" {
+			conf += `,"prevResult":` + prevResult
+		}
+		return []byte(conf + "}")
+	}
+
+	cases := []struct {
+		name      string
+		saved     []*NetConf
+		stdin     []byte
+		vlan      uint
+		errorCode uint
+		errorText string
+	}{
+		{
+			name:      "config version without CHECK",
+			stdin:     stdin("0.3.1", prevResult),
+			errorCode: types040.ErrIncompatibleCNIVersion,
+		},
+		{
+			name:      "no prevResult",
+			stdin:     stdin("0.4.0", ""),
+			errorText: "required prevResult missing",
+		},
+		{
+			name:      "prevResult interface without saved netconf",
+			stdin:     stdin("0.4.0", prevResult),
+			errorCode: errCodeInterfaceDrift,
+		},
+		{
+			name:  "pod without RDMA interfaces",
+			stdin: stdin("0.4.0", `{"cniVersion":"0.4.0"}`),
+		},
+		{
+			name:  "interface as set up",
+			saved: []*NetConf{eth0},
+			stdin: stdin("0.4.0", prevResult),
+			vlan:  100,
+		},
+		{
+			name:      "vlan changed",
+			saved:     []*NetConf{eth0},
+			stdin:     stdin("0.4.0", prevResult),
+			vlan:      200,
+			errorCode: errCodeInterfaceDrift,
+		},
+		{
+			name:      "address removed",
+			saved:     []*NetConf{eth0},
+			stdin:     stdin("0.4.0", strings.Replace(prevResult, "10.0.0.2/24", "10.0.0.3/24", 1)),
+			vlan:      100,
+			errorCode: errCodeInterfaceDrift,
+		},
+		{
+			name:      "shared netdev missing",
+			saved:     []*NetConf{eth0, eth1},
+			stdin:     stdin("0.4.0", prevResult),
+			vlan:      100,
+			errorCode: errCodeInterfaceDrift,
+			errorText: `"eth1d1"`,
+		},
+	}
+
+	for i, c := range cases {
+		cid := fmt.Sprintf("c%d", i)
+		for _, saved := range c.saved {
+			if err := saveNetConf(cid, dir, saved); err != nil {
+				t.Fatal(err)
+			}
+		}
+		vlan = c.vlan
+
+		err := cmdCheck(&skel.CmdArgs{ContainerID: cid, Netns: netns.Path(), StdinData: c.stdin})
+		switch {
+		case c.errorCode == 0 && c.errorText == "":
+			if err != nil {
+				t.Errorf("%s: %v", c.name, err)
+			}
+		case err == nil:
+			t.Errorf("%s: no error", c.name)
+		case c.errorCode != 0 && !wantCode(err, c.errorCode):
+			t.Errorf("%s: error %v, want code %d", c.name, err, c.errorCode)
+		case !strings.Contains(err.Error(), c.errorText):
+			t.Errorf("%s: error %v, want it to contain %q", c.name, err, c.errorText)
+		}
+	}
+}
@@ -236,6 +236,9 @@ type Interface struct {
 	Name    string `json:"name"`
 	Mac     string `json:"mac,omitempty"`
 	Sandbox string `json:"sandbox,omitempty"`
+	PciID   string `json:"pciID,omitempty"`
+	// the device node userspace drivers open, e.g. /dev/vfio/<group>
+	DevicePath string `json:"devicePath,omitempty"`
 }
 
 func (i *Interface) String() string {
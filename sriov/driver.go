@@ -0,0 +1,190 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// sysBusPciDir is the sysfs directory of the PCI bus. The driver binding
+// below only goes through the files of this directory, so no userspace
+// tool like dpdk-devbind.py is needed on the node.
+var sysBusPciDir = "/sys/bus/pci"
+
+// sysModuleDir lists the kernel modules that are loaded.
+var sysModuleDir = "/sys/module"
+
+// getPciDriver returns the name of the driver the PCI device is bound to,
+// or "" if it is not bound to any driver.
+func getPciDriver(pciAddr string) (string, error) {
+	devDir := filepath.Join(sysBusPciDir, "devices", pciAddr)
+	if _, err := os.Stat(devDir); err != nil {
+		return "", fmt.Errorf("PCI device %s not found: %v", pciAddr, err)
+	}
+
+	driverLink, err := os.Readlink(filepath.Join(devDir, "driver"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+		return "", fmt.Errorf("failed to read the driver of PCI device %s: %v", pciAddr, err)
+	}
+
+	return filepath.Base(driverLink), nil
+}
+
+// checkDriverLoaded fails if the kernel has no PCI driver of the given
+// name, which means its module was never loaded.
+func checkDriverLoaded(driver string) error {
+	if _, err := os.Stat(filepath.Join(sysBusPciDir, "drivers", driver)); err == nil {
+		return nil
+	}
+
+	// module names use underscores where driver names may use dashes
+	module := strings.Replace(driver, "-", "_", -1)
+	if _, err := os.Stat(filepath.Join(sysModuleDir, module)); err == nil {
+		return fmt.Errorf("module %s is loaded but registers no PCI driver named %q", module, driver)
+	}
+
+	return fmt.Errorf("driver %q is not loaded, load it with \"modprobe %s\"", driver, module)
+}
+
+func writeSysfs(path, value string) error {
+	if err := ioutil.WriteFile(path, []byte(value), 0200); err != nil {
+		return fmt.Errorf("failed to write %q to %s: %v", value, path, err)
+	}
+	return nil
+}
+
+// bindPciDriver binds the PCI device to the driver through sysfs. The
+// device is unbound from its current driver, driver_override pins the
+// target driver and drivers_probe makes the kernel bind it. With pin the
+// override stays set so that no other driver claims the device afterwards,
+// which is what the DPDK and vfio drivers need; otherwise it is cleared
+// once the device is bound, so that later probes pick the driver as usual.
+func bindPciDriver(pciAddr, driver string, pin bool) error {
+	if driver == "" {
+		return fmt.Errorf("no driver given to bind PCI device %s to", pciAddr)
+	}
+
+	if err := checkDriverLoaded(driver); err != nil {
+		return fmt.Errorf("cannot bind PCI device %s: %v", pciAddr, err)
+	}
+
+	current, err := getPciDriver(pciAddr)
+	if err != nil {
+		return err
+	}
+
+	devDir := filepath.Join(sysBusPciDir, "devices", pciAddr)
+	if current != driver {
+		if err = probePciDriver(pciAddr, current, driver); err != nil {
+			return err
+		}
+	}
+
+	if !pin {
+		if err = writeSysfs(filepath.Join(devDir, "driver_override"), "\n"); err != nil {
+			return fmt.Errorf("failed to clear the driver override of PCI device %s: %v", pciAddr, err)
+		}
+	}
+
+	return nil
+}
+
+// probePciDriver moves the PCI device from its current driver, if any, to
+// the given one.
+func probePciDriver(pciAddr, current, driver string) error {
+	devDir := filepath.Join(sysBusPciDir, "devices", pciAddr)
+	err := writeSysfs(filepath.Join(devDir, "driver_override"), driver)
+	if err != nil {
+		return fmt.Errorf("failed to set the driver override of PCI device %s: %v", pciAddr, err)
+	}
+
+	if current != "" {
+		if err = writeSysfs(filepath.Join(devDir, "driver", "unbind"), pciAddr); err != nil {
+			return fmt.Errorf("failed to unbind PCI device %s from %s: %v", pciAddr, current, err)
+		}
+	}
+
+	if err = writeSysfs(filepath.Join(sysBusPciDir, "drivers_probe"), pciAddr); err != nil {
+		return fmt.Errorf("failed to probe PCI device %s with %s: %v", pciAddr, driver, err)
+	}
+
+	bound, err := getPciDriver(pciAddr)
+	if err != nil {
+		return err
+	}
+	if bound != driver {
+		if bound == "" {
+			return fmt.Errorf("driver %s refused PCI device %s, the device is left unbound", driver, pciAddr)
+		}
+		return fmt.Errorf("PCI device %s is bound to %s instead of %s", pciAddr, bound, driver)
+	}
+
+	return nil
+}
+
+const vfioDriver = "vfio-pci"
+
+// sysIommuGroupsDir holds one directory per IOMMU group; it is empty when
+// the IOMMU is disabled in firmware or on the kernel command line.
+var sysIommuGroupsDir = "/sys/kernel/iommu_groups"
+
+// devVfioDir holds the character device of every IOMMU group that is
+// bound to vfio.
+var devVfioDir = "/dev/vfio"
+
+func checkIommuEnabled() error {
+	groups, err := ioutil.ReadDir(sysIommuGroupsDir)
+	if err != nil || len(groups) == 0 {
+		return fmt.Errorf("the IOMMU is not enabled, enable VT-d/AMD-Vi and boot with intel_iommu=on or amd_iommu=on")
+	}
+	return nil
+}
+
+// getIommuGroup returns the IOMMU group of the PCI device.
+func getIommuGroup(pciAddr string) (string, error) {
+	groupLink, err := os.Readlink(filepath.Join(sysBusPciDir, "devices", pciAddr, "iommu_group"))
+	if err != nil {
+		return "", fmt.Errorf("failed to find the IOMMU group of PCI device %s: %v", pciAddr, err)
+	}
+	return filepath.Base(groupLink), nil
+}
+
+// getVfioDevice returns the /dev/vfio path the PCI device is reachable
+// through once it is bound to vfio-pci. vfio can only hand out a group
+// whose devices are all bound to vfio-pci or unbound, so other devices in
+// the group that are bound to another driver make this fail.
+func getVfioDevice(pciAddr string) (string, error) {
+	if err := checkIommuEnabled(); err != nil {
+		return "", err
+	}
+
+	group, err := getIommuGroup(pciAddr)
+	if err != nil {
+		return "", err
+	}
+
+	devices, err := ioutil.ReadDir(filepath.Join(sysIommuGroupsDir, group, "devices"))
+	if err != nil {
+		return "", fmt.Errorf("failed to list the devices of IOMMU group %s: %v", group, err)
+	}
+	for _, dev := range devices {
+		if dev.Name() == pciAddr {
+			continue
+		}
+		driver, err := getPciDriver(dev.Name())
+		if err != nil {
+			return "", err
+		}
+		if driver != "" && driver != vfioDriver {
+			return "", fmt.Errorf("IOMMU group %s of PCI device %s is shared with %s bound to %s",
+				group, pciAddr, dev.Name(), driver)
+		}
+	}
+
+	return filepath.Join(devVfioDir, group), nil
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/containernetworking/cni/pkg/types"
+)
+
+// Error codes returned by the plugin. The CNI spec reserves the codes
+// below 100; the values below are part of the plugin's interface and
+// must not be renumbered.
+const (
+	// a pod interface no longer matches what cmdAdd configured
+	errCodeInterfaceDrift uint = 101
+	// the node lock could not be acquired in time
+	errCodeNodeLock uint = 102
+	// the RDMA hardware daemon on the node could not be queried
+	errCodeHardwareDaemonUnreachable uint = 103
+	// the pod's RDMA interfaces do not fit the free VFs and bandwidth
+	errCodeInsufficientRdmaResources uint = 104
+	// the pod being set up does not exist in the Kubernetes API
+	errCodePodNotFound uint = 105
+	// the Kubernetes API could not be reached or refused the request
+	errCodeKubernetesAPI uint = 106
+	// the rdma_interfaces_required annotation of the pod is malformed
+	errCodeInvalidPodRequirements uint = 107
+	// CNI_ARGS holds a malformed value
+	errCodeInvalidArgs uint = 108
+	// runtimeConfig holds a malformed or unsatisfiable capability value
+	errCodeInvalidRuntimeConfig uint = 109
+	// the VF chosen for a pod interface was taken in the meantime
+	errCodeVfUnavailable uint = 110
+)
+
+// newError builds a CNI error whose Msg is stable for a given code and
+// whose Details carry the specifics of the failure.
+func newError(code uint, msg string, format string, args ...interface{}) *types.Error {
+	return &types.Error{
+		Code:    code,
+		Msg:     msg,
+		Details: fmt.Sprintf(format, args...),
+	}
+}
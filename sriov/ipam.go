@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"github.com/rit-k8s-rdma/rit-k8s-rdma-sriov-cni/sriov/cni/types/current"
+
+	"github.com/containernetworking/cni/pkg/invoke"
+	"github.com/containernetworking/cni/pkg/ip"
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/vishvananda/netlink"
+)
+
+// execIPAMAdd runs the IPAM plugin of the network with the given
+// CNI_ARGS and returns its result in whatever spec version the plugin
+// answered with. The vendored ipam.ExecAdd only understands 0.1.0/0.2.0
+// results.
+func execIPAMAdd(plugin string, netconf []byte, cniArgs string) (*current.Result, error) {
+	pluginPath, err := invoke.FindInPath(plugin, filepath.SplitList(os.Getenv("CNI_PATH")))
+	if err != nil {
+		return nil, err
+	}
+
+	stdout := &bytes.Buffer{}
+	cmd := exec.Command(pluginPath)
+	cmd.Env = append(os.Environ(), "CNI_ARGS="+cniArgs)
+	cmd.Stdin = bytes.NewBuffer(netconf)
+	cmd.Stdout = stdout
+	cmd.Stderr = os.Stderr
+	if err = cmd.Run(); err != nil {
+		if _, ok := err.(*exec.ExitError); ok {
+			emsg := &types.Error{}
+			if perr := json.Unmarshal(stdout.Bytes(), emsg); perr != nil {
+				return nil, fmt.Errorf("netplugin failed but error parsing its diagnostic message %q: %v", stdout.String(), perr)
+			}
+			return nil, emsg
+		}
+		return nil, err
+	}
+
+	return parseResult(stdout.Bytes())
+}
+
+// execIPAMDel releases what the IPAM plugin handed out for a pod
+// interface, running it with the network configuration, CNI_CONTAINERID,
+// CNI_IFNAME and CNI_ARGS of the ADD. The vendored ipam.ExecDel refuses to
+// run unless CNI_COMMAND is DEL, so it cannot roll back a failed ADD.
+func execIPAMDel(handle *ipamHandle) error {
+	if len(handle.Netconf) == 0 {
+		return fmt.Errorf("no network configuration recorded to run %s with", handle.Type)
+	}
+
+	pluginPath, err := invoke.FindInPath(handle.Type, filepath.SplitList(os.Getenv("CNI_PATH")))
+	if err != nil {
+		return err
+	}
+
+	stdout := &bytes.Buffer{}
+	cmd := exec.Command(pluginPath)
+	cmd.Env = append(os.Environ(), "CNI_COMMAND=DEL", "CNI_CONTAINERID="+handle.ContainerID,
+		"CNI_IFNAME="+handle.IfName, "CNI_ARGS="+handle.Args)
+	cmd.Stdin = bytes.NewBuffer(handle.Netconf)
+	cmd.Stdout = stdout
+	cmd.Stderr = os.Stderr
+	if err = cmd.Run(); err != nil {
+		if _, ok := err.(*exec.ExitError); ok {
+			emsg := &types.Error{}
+			if perr := json.Unmarshal(stdout.Bytes(), emsg); perr != nil {
+				return fmt.Errorf("netplugin failed but error parsing its diagnostic message %q: %v", stdout.String(), perr)
+			}
+			return emsg
+		}
+		return err
+	}
+
+	return nil
+}
+
+// configureIface applies every address and route of res to ifName. It
+// is the multi-address counterpart of the vendored ipam.ConfigureIface.
+func configureIface(ifName string, res *current.Result) error {
+	link, err := netlink.LinkByName(ifName)
+	if err != nil {
+		return fmt.Errorf("failed to lookup %q: %v", ifName, err)
+	}
+
+	if err := netlink.LinkSetUp(link); err != nil {
+		return fmt.Errorf("failed to set %q UP: %v", ifName, err)
+	}
+
+	var v4gw, v6gw net.IP
+	for _, ipc := range res.IPs {
+		addr := &netlink.Addr{IPNet: &ipc.Address, Label: ""}
+		if err = netlink.AddrAdd(link, addr); err != nil {
+			return fmt.Errorf("failed to add IP addr %v to %q: %v", ipc.Address, ifName, err)
+		}
+
+		if ipc.Address.IP.To4() != nil {
+			if v4gw == nil {
+				v4gw = ipc.Gateway
+			}
+		} else if v6gw == nil {
+			v6gw = ipc.Gateway
+		}
+	}
+
+	for _, r := range res.Routes {
+		gw := r.GW
+		if gw == nil {
+			if r.Dst.IP.To4() != nil {
+				gw = v4gw
+			} else {
+				gw = v6gw
+			}
+		}
+		if err = ip.AddRoute(&r.Dst, gw, link); err != nil {
+			// we skip over duplicate routes as we assume the first one wins
+			if !os.IsExist(err) {
+				return fmt.Errorf("failed to add route '%v via %v dev %v': %v", r.Dst, gw, ifName, err)
+			}
+		}
+	}
+
+	return nil
+}
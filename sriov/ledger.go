@@ -0,0 +1,249 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// The allocation ledger records for every container what cmdAdd did to
+// the VFs it handed to the pod. Every VF is recorded before it is touched,
+// so cmdDel undoes what was done instead of guessing it from the live
+// state of the node.
+
+// ledgerDirName is the directory under cniDir holding one ledger file per
+// container.
+const ledgerDirName = "allocations"
+
+// how the VF of a pod interface is set up
+const (
+	vfModeIPAM = "ipam"
+	vfModeL2   = "l2"
+	vfModeDPDK = "dpdk"
+)
+
+// ipamHandle is what the IPAM plugin needs to release the addresses of a
+// pod interface.
+type ipamHandle struct {
+	Type string `json:"type"`
+	// CNI_CONTAINERID, CNI_IFNAME and CNI_ARGS the plugin was run with
+	ContainerID string `json:"containerID"`
+	IfName      string `json:"ifName"`
+	Args        string `json:"args,omitempty"`
+	// addresses the plugin handed out, empty until it answered
+	IPs []string `json:"ips,omitempty"`
+	// set once the plugin released the addresses
+	Released bool `json:"released,omitempty"`
+	// network configuration the plugin was run with on ADD, which is what
+	// it needs on DEL, whichever network the ledger is released from
+	Netconf json.RawMessage `json:"netconf,omitempty"`
+}
+
+// vfAllocation is one VF handed to a pod interface.
+type vfAllocation struct {
+	PodIfName string `json:"podIfName"`
+	PFName    string `json:"pfName"`
+	VF        int    `json:"vf"`
+	PCIAddr   string `json:"pciAddr"`
+	// name and MAC of the VF netdev in the host netns before cmdAdd
+	// touched it. A shared VF has a second netdev, moved into the pod as
+	// <podIfName>d1.
+	OrigName       string `json:"origName,omitempty"`
+	OrigMAC        string `json:"origMac,omitempty"`
+	SharedOrigName string `json:"sharedOrigName,omitempty"`
+	// MAC the pod interface was given, if any
+	MAC string `json:"mac,omitempty"`
+
+	VLAN      int    `json:"vlan,omitempty"`
+	MinTxRate uint   `json:"minTxRate,omitempty"`
+	MaxTxRate uint   `json:"maxTxRate,omitempty"`
+	Mode      string `json:"mode"`
+	// driver the VF is bound back to in DPDK mode
+	KernelDriver string `json:"kernelDriver,omitempty"`
+
+	IPAM *ipamHandle `json:"ipam,omitempty"`
+
+	// set once the VF is given back to the host, while the addresses may
+	// still be waiting for the IPAM plugin
+	VFReleased bool `json:"vfReleased,omitempty"`
+
+	// why the last release of the VF failed, kept for the next DEL
+	LastError string `json:"lastError,omitempty"`
+}
+
+// podLedger is the ledger of one container.
+type podLedger struct {
+	ContainerID  string          `json:"containerID"`
+	Netns        string          `json:"netns"`
+	PodNamespace string          `json:"podNamespace,omitempty"`
+	PodName      string          `json:"podName,omitempty"`
+	Allocations  []*vfAllocation `json:"allocations"`
+}
+
+func ledgerPath(dataDir, cid string) string {
+	return filepath.Join(dataDir, ledgerDirName, cid+".json")
+}
+
+// loadLedger returns the ledger of the container, or nil if cmdAdd
+// recorded nothing for it.
+func loadLedger(dataDir, cid string) (*podLedger, error) {
+	path := ledgerPath(dataDir, cid)
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read the allocation ledger %q: %v", path, err)
+	}
+
+	l := &podLedger{}
+	if err = json.Unmarshal(data, l); err != nil {
+		return nil, fmt.Errorf("failed to parse the allocation ledger %q: %v", path, err)
+	}
+	return l, nil
+}
+
+// listLedgers returns the ledger of every container on the node.
+func listLedgers(dataDir string) ([]*podLedger, error) {
+	files, err := ioutil.ReadDir(filepath.Join(dataDir, ledgerDirName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to list the allocation ledgers in %q: %v", dataDir, err)
+	}
+
+	var ledgers []*podLedger
+	for _, f := range files {
+		// skip the temporary files of an interrupted save
+		if !strings.HasSuffix(f.Name(), ".json") {
+			continue
+		}
+		l, err := loadLedger(dataDir, strings.TrimSuffix(f.Name(), ".json"))
+		if err != nil {
+			return nil, err
+		}
+		if l != nil {
+			ledgers = append(ledgers, l)
+		}
+	}
+	return ledgers, nil
+}
+
+// allocation returns the VF recorded for the pod interface, or nil.
+func (l *podLedger) allocation(podIfName string) *vfAllocation {
+	for _, a := range l.Allocations {
+		if a.PodIfName == podIfName {
+			return a
+		}
+	}
+	return nil
+}
+
+// record adds the allocation to the ledger, replacing the one of the same
+// pod interface. The ledger still needs to be saved.
+func (l *podLedger) record(a *vfAllocation) {
+	for i := range l.Allocations {
+		if l.Allocations[i].PodIfName == a.PodIfName {
+			l.Allocations[i] = a
+			return
+		}
+	}
+	l.Allocations = append(l.Allocations, a)
+}
+
+// forget drops the allocation of the pod interface once its VF is
+// released. The ledger still needs to be saved.
+func (l *podLedger) forget(podIfName string) {
+	for i := range l.Allocations {
+		if l.Allocations[i].PodIfName == podIfName {
+			l.Allocations = append(l.Allocations[:i], l.Allocations[i+1:]...)
+			return
+		}
+	}
+}
+
+// save writes the ledger so that a crash at any point leaves either the
+// previous or the new content on disk.
+func (l *podLedger) save(dataDir string) error {
+	data, err := json.Marshal(l)
+	if err != nil {
+		return fmt.Errorf("failed to serialize the allocation ledger of %s: %v", l.ContainerID, err)
+	}
+	return writeFileAtomic(ledgerPath(dataDir, l.ContainerID), data, 0600)
+}
+
+// removeLedger forgets the container once all its VFs are released.
+func removeLedger(dataDir, cid string) error {
+	path := ledgerPath(dataDir, cid)
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove the allocation ledger %q: %v", path, err)
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// writeFileAtomic writes data to a temporary file in the directory of
+// path, flushes it to disk and renames it over path.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("failed to create the directory %q: %v", dir, err)
+	}
+
+	tmp, err := ioutil.TempFile(dir, "."+filepath.Base(path)+".tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create a temporary file in %q: %v", dir, err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err = tmp.Write(data); err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), perm)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write %q: %v", tmp.Name(), err)
+	}
+
+	if err = os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to rename %q to %q: %v", tmp.Name(), path, err)
+	}
+	return syncDir(dir)
+}
+
+// syncDir flushes the entries of the directory, which makes a rename or
+// remove in it durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("failed to open the directory %q: %v", dir, err)
+	}
+	defer d.Close()
+
+	if err = d.Sync(); err != nil {
+		return fmt.Errorf("failed to sync the directory %q: %v", dir, err)
+	}
+	return nil
+}
+
+// vfMode is the mode the VFs of the network are set up in.
+func (n *NetConf) vfMode() string {
+	switch {
+	case n.DPDKMode:
+		return vfModeDPDK
+	case n.L2Mode:
+		return vfModeL2
+	default:
+		return vfModeIPAM
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// The tests of this file and the other *_test.go files next to it need no
+// SR-IOV hardware, so they are plain Go tests that run besides the ginkgo
+// suite of sriov_test.go, which needs PF_INTERFACE.
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "sriov-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func testLedger(cid string, podIfNames ...string) *podLedger {
+	l := &podLedger{ContainerID: cid, Netns: "/var/run/netns/" + cid}
+	for i, name := range podIfNames {
+		l.Allocations = append(l.Allocations, &vfAllocation{
+			PodIfName: name,
+			PFName:    "ens1f0",
+			VF:        i,
+			PCIAddr:   "0000:03:00.1",
+			Mode:      vfModeIPAM,
+		})
+	}
+	return l
+}
+
+func TestWriteFileAtomic(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "sub", "file.json")
+	for _, content := range []string{"first", "second"} {
+		if err := writeFileAtomic(path, []byte(content), 0600); err != nil {
+			t.Fatalf("writing %q: %v", content, err)
+		}
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "second" {
+		t.Errorf("content is %q, want %q", data, "second")
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("mode is %v, want 0600", info.Mode().Perm())
+	}
+
+	files, err := ioutil.ReadDir(filepath.Dir(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Errorf("temporary files left behind: %d files in %s", len(files), filepath.Dir(path))
+	}
+}
+
+func TestLedgerSaveLoad(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	l := testLedger("c1", "eth0", "eth1")
+	l.Allocations[0].IPAM = &ipamHandle{
+		Type:        "host-local",
+		ContainerID: "c1",
+		IfName:      "eth0",
+		IPs:         []string{"10.0.0.2/24"},
+		Netconf:     []byte(`{"name":"mynet","ipam":{"type":"host-local"}}`),
+	}
+	if err := l.save(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(ledgerPath(dir, "corrupt"), []byte("{"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		cid     string
+		want    *podLedger
+		wantErr bool
+	}{
+		{cid: "c1", want: l},
+		{cid: "missing", want: nil},
+		{cid: "corrupt", wantErr: true},
+	}
+	for _, c := range cases {
+		got, err := loadLedger(dir, c.cid)
+		if (err != nil) != c.wantErr {
+			t.Errorf("%s: error %v, want error %v", c.cid, err, c.wantErr)
+			continue
+		}
+		if !c.wantErr && !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: loaded %+v, want %+v", c.cid, got, c.want)
+		}
+	}
+}
+
+func TestListLedgers(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	ledgers, err := listLedgers(dir)
+	if err != nil || len(ledgers) != 0 {
+		t.Fatalf("listing a missing directory: %v, %v", ledgers, err)
+	}
+
+	for _, cid := range []string{"c1", "c2"} {
+		if err = testLedger(cid, "eth0").save(dir); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tmp := filepath.Join(dir, ledgerDirName, ".c3.json.tmp123456")
+	if err = ioutil.WriteFile(tmp, []byte("{"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	ledgers, err = listLedgers(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cids []string
+	for _, l := range ledgers {
+		cids = append(cids, l.ContainerID)
+	}
+	sort.Strings(cids)
+	if !reflect.DeepEqual(cids, []string{"c1", "c2"}) {
+		t.Errorf("listed %v, want [c1 c2]", cids)
+	}
+}
+
+func TestRemoveLedger(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	if err := testLedger("c1", "eth0").save(dir); err != nil {
+		t.Fatal(err)
+	}
+	// removing twice is fine, DEL may be retried
+	for i := 0; i < 2; i++ {
+		if err := removeLedger(dir, "c1"); err != nil {
+			t.Fatalf("remove #%d: %v", i+1, err)
+		}
+	}
+	if l, err := loadLedger(dir, "c1"); l != nil || err != nil {
+		t.Errorf("ledger still there after remove: %v, %v", l, err)
+	}
+}
+
+func TestLedgerRecordForget(t *testing.T) {
+	cases := []struct {
+		ledger *podLedger
+		record string
+		forget string
+		want   []string
+	}{
+		{ledger: testLedger("c"), record: "eth0", want: []string{"eth0"}},
+		{ledger: testLedger("c", "eth0"), record: "eth1", want: []string{"eth0", "eth1"}},
+		{ledger: testLedger("c", "eth0", "eth1"), record: "eth0", want: []string{"eth0", "eth1"}},
+		{ledger: testLedger("c", "eth0", "eth1", "eth2"), forget: "eth1", want: []string{"eth0", "eth2"}},
+		{ledger: testLedger("c", "eth0"), forget: "eth1", want: []string{"eth0"}},
+		{ledger: testLedger("c", "eth0"), forget: "eth0", want: []string{}},
+	}
+
+	for _, c := range cases {
+		if c.record != "" {
+			a := &vfAllocation{PodIfName: c.record, VF: 7}
+			c.ledger.record(a)
+			if c.ledger.allocation(c.record) != a {
+				t.Errorf("record %s: allocation not replaced", c.record)
+			}
+		}
+		if c.forget != "" {
+			c.ledger.forget(c.forget)
+			if c.ledger.allocation(c.forget) != nil {
+				t.Errorf("forget %s: allocation still there", c.forget)
+			}
+		}
+		got := []string{}
+		for _, a := range c.ledger.Allocations {
+			got = append(got, a.PodIfName)
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("record %q forget %q: interfaces %v, want %v", c.record, c.forget, got, c.want)
+		}
+	}
+}
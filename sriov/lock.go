@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// nodeLockPath is the file ADD, DEL and reconcile lock to run one at a
+// time on the node. It is the same for every network, since they share
+// the PFs.
+var nodeLockPath = "/var/run/rdma-sriov-cni.lock"
+
+// defaultLockTimeout is how long to wait for the node lock unless the
+// network configuration sets lockTimeout.
+const defaultLockTimeout = 2 * time.Minute
+
+// lockHolder is written to the lock file by the process holding the lock,
+// so that a process that times out can tell who it waited for.
+type lockHolder struct {
+	PID         int       `json:"pid"`
+	ContainerID string    `json:"containerID,omitempty"`
+	Command     string    `json:"command"`
+	Since       time.Time `json:"since"`
+}
+
+func (h *lockHolder) String() string {
+	s := fmt.Sprintf("pid %d (%s", h.PID, h.Command)
+	if h.ContainerID != "" {
+		s += " of container " + h.ContainerID
+	}
+	return s + fmt.Sprintf(") since %s", h.Since.Format(time.RFC3339))
+}
+
+// nodeLock is an flock on nodeLockPath. The kernel drops the lock when the
+// holder exits, even if it crashed, so a lock that is held always belongs
+// to a running process.
+type nodeLock struct {
+	file *os.File
+}
+
+// acquireNodeLock waits up to timeout for the node lock, 0 meaning
+// defaultLockTimeout. The error names the holder when it timed out.
+func acquireNodeLock(command string, containerID string, timeout time.Duration) (*nodeLock, error) {
+	if timeout == 0 {
+		timeout = defaultLockTimeout
+	}
+
+	if err := os.MkdirAll(filepath.Dir(nodeLockPath), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create the directory of the node lock %s: %v", nodeLockPath, err)
+	}
+	file, err := os.OpenFile(nodeLockPath, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open the node lock %s: %v", nodeLockPath, err)
+	}
+
+	log.Println("RIT-CNI: Attempting to acquire the node lock.")
+	deadline := time.Now().Add(timeout)
+	for {
+		err = unix.Flock(int(file.Fd()), unix.LOCK_EX|unix.LOCK_NB)
+		if err == nil {
+			break
+		}
+		if err != unix.EWOULDBLOCK && err != unix.EINTR {
+			file.Close()
+			return nil, fmt.Errorf("failed to lock %s: %v", nodeLockPath, err)
+		}
+		if time.Now().After(deadline) {
+			holder := readLockHolder(file)
+			file.Close()
+			return nil, fmt.Errorf("timed out after %v waiting for the node lock %s held by %s", timeout, nodeLockPath, holder)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	holder := &lockHolder{
+		PID:         os.Getpid(),
+		ContainerID: containerID,
+		Command:     command,
+		Since:       time.Now(),
+	}
+	if data, err := json.Marshal(holder); err == nil {
+		// only used for diagnostics, a stale or partial record is harmless
+		if err = file.Truncate(0); err == nil {
+			_, err = file.WriteAt(data, 0)
+		}
+		if err != nil {
+			log.Printf("RIT-CNI: failed to record the holder of the node lock: %v\n", err)
+		}
+	}
+
+	log.Println("RIT-CNI: Successfully acquired the node lock.")
+	return &nodeLock{file: file}, nil
+}
+
+// readLockHolder describes the process holding the lock file, as far as it
+// recorded itself.
+func readLockHolder(file *os.File) string {
+	data, err := ioutil.ReadAll(io.NewSectionReader(file, 0, 4096))
+	if err != nil || len(data) == 0 {
+		return "an unknown process"
+	}
+	holder := &lockHolder{}
+	if err = json.Unmarshal(data, holder); err != nil {
+		return "an unknown process"
+	}
+	return holder.String()
+}
+
+// release clears the holder record and drops the lock.
+func (l *nodeLock) release() error {
+	defer l.file.Close()
+
+	if err := l.file.Truncate(0); err != nil {
+		log.Printf("RIT-CNI: failed to clear the holder of the node lock: %v\n", err)
+	}
+	if err := unix.Flock(int(l.file.Fd()), unix.LOCK_UN); err != nil {
+		return fmt.Errorf("failed to unlock %s: %v", nodeLockPath, err)
+	}
+
+	log.Println("RIT-CNI: Successfully released the node lock.")
+	return nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// withLockPath points nodeLockPath into a temporary directory for the
+// duration of a test.
+func withLockPath(t *testing.T) func() {
+	dir := tempDir(t)
+	orig := nodeLockPath
+	nodeLockPath = filepath.Join(dir, "run", "sriov.lock")
+	return func() {
+		nodeLockPath = orig
+		os.RemoveAll(dir)
+	}
+}
+
+func TestNodeLockExclusive(t *testing.T) {
+	defer withLockPath(t)()
+
+	lock, err := acquireNodeLock("ADD", "c1", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = acquireNodeLock("DEL", "c2", 200*time.Millisecond)
+	if err == nil {
+		t.Fatal("acquired the lock while it was held")
+	}
+	for _, want := range []string{
+		"timed out after 200ms",
+		fmt.Sprintf("held by pid %d (ADD of container c1) since ", os.Getpid()),
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error %q does not contain %q", err, want)
+		}
+	}
+
+	if err = lock.release(); err != nil {
+		t.Fatal(err)
+	}
+	lock, err = acquireNodeLock("DEL", "c2", time.Second)
+	if err != nil {
+		t.Fatalf("lock not free after release: %v", err)
+	}
+	lock.release()
+}
+
+func TestNodeLockHolder(t *testing.T) {
+	defer withLockPath(t)()
+
+	since := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC).Format(time.RFC3339)
+	cases := []struct {
+		content string
+		holder  string
+	}{
+		{"", "an unknown process"},
+		{"{", "an unknown process"},
+		{`{"pid":42,"command":"reconcile","since":"2020-01-02T03:04:05Z"}`, "pid 42 (reconcile) since " + since},
+		{`{"pid":42,"containerID":"c1","command":"ADD","since":"2020-01-02T03:04:05Z"}`,
+			"pid 42 (ADD of container c1) since " + since},
+	}
+
+	if err := os.MkdirAll(filepath.Dir(nodeLockPath), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range cases {
+		if err := ioutil.WriteFile(nodeLockPath, []byte(c.content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		holder, err := os.Open(nodeLockPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = unix.Flock(int(holder.Fd()), unix.LOCK_EX); err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = acquireNodeLock("DEL", "c2", 100*time.Millisecond)
+		if err == nil || !strings.HasSuffix(err.Error(), "held by "+c.holder) {
+			t.Errorf("holder record %q: error %v, want it to name %q", c.content, err, c.holder)
+		}
+		holder.Close()
+	}
+}
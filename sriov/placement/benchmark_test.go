@@ -0,0 +1,81 @@
+package placement
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+
+	"github.com/rit-k8s-rdma/rit-k8s-rdma-common/knapsack_pod_placement"
+	"github.com/rit-k8s-rdma/rit-k8s-rdma-common/rdma_hardware_info"
+)
+
+// benchmarkCase builds a node of 8 PFs with 25G each and a pod whose
+// interfaces ask for up to half of the bandwidth left on the node, so the
+// placers have to balance the PFs but always find a placement.
+func benchmarkCase(interfaces int) ([]Request, *Inventory) {
+	rng := rand.New(rand.NewSource(int64(interfaces)))
+
+	pfs := make([]rdma_hardware_info.PF, 8)
+	var free uint
+	for i := range pfs {
+		pfs[i] = rdma_hardware_info.PF{
+			Name:           fmt.Sprintf("pf%d", i),
+			CapacityTxRate: 25000,
+			UsedTxRate:     uint(rng.Intn(10)) * 1000,
+			CapacityVFs:    32,
+			UsedVFs:        uint(rng.Intn(8)),
+		}
+		free += pfs[i].CapacityTxRate - pfs[i].UsedTxRate
+	}
+
+	// no more than a third of a PF per interface
+	share := free / uint(2*interfaces)
+	if share > 8000 {
+		share = 8000
+	}
+	requests := make([]Request, interfaces)
+	for i := range requests {
+		requests[i].MinTxRate = uint(rng.Intn(int(share))) / 100 * 100
+	}
+
+	return requests, NewInventory(pfs)
+}
+
+func BenchmarkPlace(b *testing.B) {
+	placers := []struct {
+		name   string
+		placer Placer
+	}{
+		{FirstFitName, FirstFit{}},
+		{BestFitName, BestFit{}},
+		{SpreadName, Spread{}},
+		{OptimalName, Optimal{}},
+	}
+
+	for _, interfaces := range []int{1, 2, 4, 8, 16} {
+		requests, inv := benchmarkCase(interfaces)
+
+		for _, p := range placers {
+			placer := p.placer
+			b.Run(fmt.Sprintf("%s/%d-interfaces", p.name, interfaces), func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					if _, ok := placer.Place(requests, inv); !ok {
+						b.Fatal("no placement found")
+					}
+				}
+			})
+		}
+
+		knapsackRequests := make([]knapsack_pod_placement.RdmaInterfaceRequest, len(requests))
+		for i := range requests {
+			knapsackRequests[i] = requests[i].RdmaInterfaceRequest
+		}
+		b.Run(fmt.Sprintf("PlacePod/%d-interfaces", interfaces), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, ok := knapsack_pod_placement.PlacePod(knapsackRequests, inv.PFs(), false); !ok {
+					b.Fatal("no placement found")
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,152 @@
+package placement
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/rit-k8s-rdma/rit-k8s-rdma-common/rdma_hardware_info"
+)
+
+// Rejection is why a PF cannot take a requested interface.
+type Rejection string
+
+const (
+	// the PF can take the interface on its own
+	NotRejected Rejection = ""
+	// every VF of the PF is in use
+	RejectedNoFreeVFs Rejection = "no free VFs"
+	// the unreserved bandwidth of the PF is below the min tx rate
+	RejectedBandwidth Rejection = "not enough bandwidth"
+	// the interface is pinned to another PF
+	RejectedPinned Rejection = "pinned to another PF"
+	// the interface requires a PF on another NUMA node
+	RejectedNUMA Rejection = "on another NUMA node"
+	// the max tx rate would take the PF over its max rate cap
+	RejectedMaxRateCap Rejection = "max rate cap reached"
+)
+
+// Candidate is a PF considered for a requested interface.
+type Candidate struct {
+	PF        string
+	Rejection Rejection
+}
+
+// InterfaceDiagnosis lists every PF considered for one interface.
+type InterfaceDiagnosis struct {
+	Interface  int
+	MinTxRate  uint
+	Candidates []Candidate
+}
+
+// Capacity is what is left of a PF before the pod is placed.
+type Capacity struct {
+	PF         string
+	FreeVFs    int
+	FreeTxRate int
+	NUMANode   int
+}
+
+// Diagnosis explains why the requests of a pod could not be placed.
+type Diagnosis struct {
+	Interfaces []InterfaceDiagnosis
+	Remaining  []Capacity
+	// every interface fits on some PF on its own, they only fail
+	// together because of their combined bandwidth, VFs or anti-affinity
+	FitIndividually bool
+}
+
+// Diagnose checks every request on its own against every PF.
+func Diagnose(requests []Request, inv *Inventory) *Diagnosis {
+	d := &Diagnosis{FitIndividually: true}
+	pfs := inv.pfs
+
+	for i, r := range requests {
+		id := InterfaceDiagnosis{Interface: i, MinTxRate: r.MinTxRate}
+		fits := false
+		for p := range pfs {
+			c := Candidate{PF: pfs[p].Name, Rejection: reject(&pfs[p], inv.usedMax[p], inv.Topology(pfs[p].Name), inv.Policy(pfs[p].Name), r)}
+			if c.Rejection == NotRejected {
+				fits = true
+			}
+			id.Candidates = append(id.Candidates, c)
+		}
+		if !fits {
+			d.FitIndividually = false
+		}
+		d.Interfaces = append(d.Interfaces, id)
+	}
+
+	for p := range pfs {
+		d.Remaining = append(d.Remaining, Capacity{
+			PF:         pfs[p].Name,
+			FreeVFs:    int(pfs[p].CapacityVFs) - int(pfs[p].UsedVFs),
+			FreeTxRate: freeTxRate(&pfs[p], inv.Policy(pfs[p].Name)),
+			NUMANode:   inv.Topology(pfs[p].Name).NUMANode,
+		})
+	}
+
+	return d
+}
+
+func reject(pf *rdma_hardware_info.PF, usedMax int, topology Topology, policy Policy, r Request) Rejection {
+	switch {
+	case r.PFName != "" && r.PFName != pf.Name:
+		return RejectedPinned
+	case r.NUMANode != nil && *r.NUMANode != topology.NUMANode:
+		return RejectedNUMA
+	case pf.CapacityVFs <= pf.UsedVFs:
+		return RejectedNoFreeVFs
+	case freeTxRate(pf, policy) < int(r.MinTxRate):
+		return RejectedBandwidth
+	case policy.maxRateCapacity(pf) >= 0 && usedMax+maxRate(pf, r.MaxTxRate) > policy.maxRateCapacity(pf):
+		return RejectedMaxRateCap
+	}
+	return NotRejected
+}
+
+// String renders the diagnosis on one line, for error messages and
+// events.
+func (d *Diagnosis) String() string {
+	var parts []string
+
+	for _, id := range d.Interfaces {
+		var fits, rejected []string
+		for _, c := range id.Candidates {
+			if c.Rejection == NotRejected {
+				fits = append(fits, c.PF)
+			} else {
+				rejected = append(rejected, fmt.Sprintf("%s %s", c.PF, c.Rejection))
+			}
+		}
+		desc := fmt.Sprintf("eth%d (min_tx_rate=%d):", id.Interface, id.MinTxRate)
+		if len(fits) > 0 {
+			desc += " fits on " + strings.Join(fits, ", ")
+			if len(rejected) > 0 {
+				desc += ";"
+			}
+		}
+		if len(rejected) > 0 {
+			desc += " rejected by " + strings.Join(rejected, ", ")
+		}
+		if len(id.Candidates) == 0 {
+			desc += " no PFs on the node"
+		}
+		parts = append(parts, desc)
+	}
+
+	if d.FitIndividually && len(d.Interfaces) > 0 {
+		parts = append(parts, "every interface fits on its own but not all of them together")
+	}
+
+	var remaining []string
+	for _, c := range d.Remaining {
+		desc := fmt.Sprintf("%s free_vfs=%d free_tx_rate=%d", c.PF, c.FreeVFs, c.FreeTxRate)
+		if c.NUMANode >= 0 {
+			desc += fmt.Sprintf(" numa_node=%d", c.NUMANode)
+		}
+		remaining = append(remaining, desc)
+	}
+	parts = append(parts, "remaining: "+strings.Join(remaining, ", "))
+
+	return strings.Join(parts, "; ")
+}
@@ -0,0 +1,78 @@
+package placement
+
+import (
+	"sort"
+)
+
+// FirstFit places every interface on the first PF it fits on, like
+// knapsack_pod_placement.PlacePod. It fills the first PFs before touching
+// the next ones.
+type FirstFit struct{}
+
+// BestFit places every interface on the PF that is left with the least
+// unreserved bandwidth, packing interfaces onto as few PFs as possible.
+type BestFit struct{}
+
+// Spread places every interface on the PF that is left with the most
+// unreserved bandwidth, spreading the load over all PFs.
+type Spread struct{}
+
+func (FirstFit) Place(requests []Request, inv *Inventory) ([]int, bool) {
+	return backtrack(requests, inv, func(s *state, i int) []int {
+		return s.preferLocal(i, s.candidates(i))
+	})
+}
+
+func (BestFit) Place(requests []Request, inv *Inventory) ([]int, bool) {
+	return backtrack(requests, inv, func(s *state, i int) []int {
+		c := s.candidates(i)
+		sort.SliceStable(c, func(a, b int) bool {
+			return s.free(c[a]) < s.free(c[b])
+		})
+		return s.preferLocal(i, c)
+	})
+}
+
+func (Spread) Place(requests []Request, inv *Inventory) ([]int, bool) {
+	return backtrack(requests, inv, func(s *state, i int) []int {
+		c := s.candidates(i)
+		sort.SliceStable(c, func(a, b int) bool {
+			return s.free(c[a]) > s.free(c[b])
+		})
+		return s.preferLocal(i, c)
+	})
+}
+
+// backtrack places the requests in order, trying the PFs in the order
+// returned by order and backing up when a request does not fit anywhere.
+// The order puts the PFs on the preferred NUMA node first.
+// The first complete placement found is returned.
+func backtrack(requests []Request, inv *Inventory, order func(*state, int) []int) ([]int, bool) {
+	s := newState(requests, inv)
+
+	var try func(i int) bool
+	try = func(i int) bool {
+		if i == len(requests) {
+			return true
+		}
+		var tried []int
+		for _, p := range order(s, i) {
+			if s.equivalentToAny(i, p, tried) {
+				continue
+			}
+			tried = append(tried, p)
+
+			s.take(i, p)
+			if try(i + 1) {
+				return true
+			}
+			s.release(i, p)
+		}
+		return false
+	}
+
+	if !try(0) {
+		return []int{}, false
+	}
+	return s.placements, true
+}
@@ -0,0 +1,259 @@
+package placement
+
+import (
+	"log"
+	"sort"
+
+	"github.com/rit-k8s-rdma/rit-k8s-rdma-common/rdma_hardware_info"
+)
+
+// Optimal searches all placements and returns the one that puts the most
+// interfaces on their preferred NUMA node and, among those, has the
+// lowest Score. The search is pruned on the score of partial placements and
+// only tries one of the PFs with equal capacity and usage, so Score must
+// not decrease when an interface is added to a PF and must rate such PFs
+// alike. With BalancedScore the search is also pruned on a lower bound of
+// the score the interfaces left to place add.
+type Optimal struct {
+	// Score rates the PFs once the interfaces are placed on them; lower
+	// is better. BalancedScore is used if nil.
+	Score func(pfs []rdma_hardware_info.PF) float64
+	// MaxSteps is the number of partial placements the search looks at
+	// before it settles for the best placement found so far, which is the
+	// Spread placement unless the search improved on it. The search runs
+	// under the node lock, so it must not hold up other pods for long
+	// however many interfaces the pod has. DefaultOptimalMaxSteps is used
+	// if 0.
+	MaxSteps int
+}
+
+// DefaultOptimalMaxSteps keeps the search for a pod with 16 interfaces
+// over 8 PFs around 50ms; smaller pods are usually searched through.
+const DefaultOptimalMaxSteps = 20000
+
+// BalancedScore sums the squared bandwidth and VF utilization of every
+// PF, which favours placements that leave every PF equally loaded.
+func BalancedScore(pfs []rdma_hardware_info.PF) float64 {
+	var score float64
+	for i := range pfs {
+		if pfs[i].CapacityTxRate > 0 {
+			u := float64(pfs[i].UsedTxRate) / float64(pfs[i].CapacityTxRate)
+			score += u * u
+		}
+		if pfs[i].CapacityVFs > 0 {
+			u := float64(pfs[i].UsedVFs) / float64(pfs[i].CapacityVFs)
+			score += u * u
+		}
+	}
+	return score
+}
+
+func (o Optimal) Place(requests []Request, inv *Inventory) ([]int, bool) {
+	// the spread placement gives a good bound to prune against early on
+	spread, ok := Spread{}.Place(requests, inv)
+	if !ok {
+		return []int{}, false
+	}
+
+	// placing the interfaces with the highest min tx rate first makes the
+	// bound below tight early on
+	order := make([]int, len(requests))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool {
+		return requests[order[a]].MinTxRate > requests[order[b]].MinTxRate
+	})
+	sorted := reorder(requests, order)
+
+	score := o.Score
+	// bound is a lower bound of the score of every complete placement
+	// that extends the current one
+	bound := func(pfs []rdma_hardware_info.PF, i int) float64 {
+		return score(pfs)
+	}
+	if score == nil {
+		score = BalancedScore
+		// what is left to place from request i on
+		rates := make([]uint, len(sorted)+1)
+		for i := len(sorted) - 1; i >= 0; i-- {
+			rates[i] = rates[i+1] + sorted[i].MinTxRate
+		}
+		bound = func(pfs []rdma_hardware_info.PF, i int) float64 {
+			return balancedBound(pfs, rates[i], uint(len(sorted)-i))
+		}
+	}
+
+	best := make([]int, len(sorted))
+	for i, r := range order {
+		best[i] = spread[r]
+	}
+	bestRemote, bestScore := scorePlacement(score, sorted, inv, best)
+
+	maxSteps := o.MaxSteps
+	if maxSteps == 0 {
+		maxSteps = DefaultOptimalMaxSteps
+	}
+
+	s := newState(sorted, inv)
+
+	steps := 0
+	var search func(i int, remote int)
+	search = func(i int, remote int) {
+		steps++
+		if steps > maxSteps || remote > bestRemote {
+			return
+		}
+		if remote == bestRemote && bound(s.pfs, i) >= bestScore {
+			return
+		}
+		if i == len(sorted) {
+			bestRemote, bestScore = remote, score(s.pfs)
+			copy(best, s.placements)
+			return
+		}
+		// the least loaded PFs first, they are the most likely to lead to
+		// a better placement
+		c := s.candidates(i)
+		sort.SliceStable(c, func(a, b int) bool {
+			return s.free(c[a]) > s.free(c[b])
+		})
+		var tried []int
+		for _, p := range s.preferLocal(i, c) {
+			if s.equivalentToAny(i, p, tried) {
+				continue
+			}
+			tried = append(tried, p)
+
+			s.take(i, p)
+			if s.local(i, p) {
+				search(i+1, remote)
+			} else {
+				search(i+1, remote+1)
+			}
+			s.release(i, p)
+		}
+	}
+	search(0, 0)
+	if steps > maxSteps {
+		log.Printf("RIT-CNI: optimal placement of %d interfaces stopped after %d steps, using the best placement found so far\n",
+			len(requests), maxSteps)
+	}
+
+	placements := make([]int, len(requests))
+	for i, r := range order {
+		placements[r] = best[i]
+	}
+	return placements, true
+}
+
+// reorder returns the requests in the given order, with distinct_from
+// pointing to the new indexes.
+func reorder(requests []Request, order []int) []Request {
+	index := make([]int, len(requests))
+	for i, r := range order {
+		index[r] = i
+	}
+
+	sorted := make([]Request, len(requests))
+	for i, r := range order {
+		sorted[i] = requests[r]
+		sorted[i].DistinctFrom = make([]int, len(requests[r].DistinctFrom))
+		for k, j := range requests[r].DistinctFrom {
+			if j >= 0 && j < len(index) {
+				j = index[j]
+			}
+			sorted[i].DistinctFrom[k] = j
+		}
+	}
+	return sorted
+}
+
+// balancedBound is the lowest BalancedScore the PFs can reach once another
+// txRate of bandwidth and vfs VFs are placed on them. Both are spread over
+// the PFs as if they could be split at will and regardless of capacity,
+// filling up the PFs with the lowest utilization first, which is what
+// minimizes a sum of squares.
+func balancedBound(pfs []rdma_hardware_info.PF, txRate uint, vfs uint) float64 {
+	used := make([]float64, len(pfs))
+	capacity := make([]float64, len(pfs))
+
+	for p := range pfs {
+		used[p], capacity[p] = float64(pfs[p].UsedTxRate), float64(pfs[p].CapacityTxRate)
+	}
+	bound := waterFill(used, capacity, float64(txRate))
+
+	for p := range pfs {
+		used[p], capacity[p] = float64(pfs[p].UsedVFs), float64(pfs[p].CapacityVFs)
+	}
+	return bound + waterFill(used, capacity, float64(vfs))
+}
+
+// waterFill returns the lowest sum of squared utilizations used/capacity
+// once amount is added to the used values of the PFs. PFs without
+// capacity do not count, as in BalancedScore.
+func waterFill(used []float64, capacity []float64, amount float64) float64 {
+	// the optimum raises every PF below some level l to used = l*capacity²,
+	// the level is found by bisection and rounded down so that the result
+	// stays a lower bound
+	added := func(level float64) float64 {
+		sum := 0.0
+		for p := range used {
+			if capacity[p] > 0 && level*capacity[p]*capacity[p] > used[p] {
+				sum += level*capacity[p]*capacity[p] - used[p]
+			}
+		}
+		return sum
+	}
+
+	var lo, hi float64
+	if amount > 0 {
+		hi = 1
+		for added(hi) < amount {
+			hi *= 2
+			if hi > 1e300 {
+				// no PF has capacity
+				hi = 0
+				break
+			}
+		}
+		for n := 0; n < 64 && hi > 0; n++ {
+			mid := (lo + hi) / 2
+			if added(mid) < amount {
+				lo = mid
+			} else {
+				hi = mid
+			}
+		}
+	}
+
+	score := 0.0
+	for p := range used {
+		if capacity[p] == 0 {
+			continue
+		}
+		u := used[p]
+		if lo*capacity[p]*capacity[p] > u {
+			u = lo * capacity[p] * capacity[p]
+		}
+		u /= capacity[p]
+		score += u * u
+	}
+	return score
+}
+
+// scorePlacement returns the number of interfaces off their preferred
+// NUMA node and the score of the placement.
+func scorePlacement(score func([]rdma_hardware_info.PF) float64, requests []Request,
+	inv *Inventory, placements []int) (int, float64) {
+
+	s := newState(requests, inv)
+	remote := 0
+	for i, p := range placements {
+		if !s.local(i, p) {
+			remote++
+		}
+		s.take(i, p)
+	}
+	return remote, score(s.pfs)
+}
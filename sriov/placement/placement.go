@@ -0,0 +1,287 @@
+// Package placement decides which PF each RDMA interface requested by a
+// pod is set up on.
+package placement
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/rit-k8s-rdma/rit-k8s-rdma-common/knapsack_pod_placement"
+	"github.com/rit-k8s-rdma/rit-k8s-rdma-common/rdma_hardware_info"
+)
+
+// Request is one RDMA interface of the rdma_interfaces_required pod
+// annotation.
+type Request struct {
+	knapsack_pod_placement.RdmaInterfaceRequest
+	// PFName pins the interface to the PF with this netdev name.
+	PFName string `json:"pf_name,omitempty"`
+	// PCIAddress pins the interface to a PF, or to a single VF, by PCI
+	// address. It is resolved to PFName before placement.
+	PCIAddress string `json:"pci_address,omitempty"`
+	// DistinctFrom lists the indexes of the interfaces of the pod that
+	// must not share a PF with this one.
+	DistinctFrom []int `json:"distinct_from,omitempty"`
+	// AntiAffinityGroup keeps all interfaces of the pod with the same
+	// group on distinct PFs.
+	AntiAffinityGroup string `json:"anti_affinity_group,omitempty"`
+	// NUMANode requires a PF attached to this NUMA node.
+	NUMANode *int `json:"numa_node,omitempty"`
+	// PreferredNUMANode places the interface on a PF attached to this
+	// NUMA node if the pod fits that way.
+	PreferredNUMANode *int `json:"preferred_numa_node,omitempty"`
+	// TopologyHint holds the NUMA nodes the Topology Manager aligned the
+	// pod to. PFs on them are preferred if PreferredNUMANode is not set.
+	TopologyHint []int `json:"-"`
+}
+
+// Placer is a placement strategy.
+type Placer interface {
+	// Place returns for every request the index of the PF in the
+	// inventory it is placed on, or false if the requests do not fit.
+	Place(requests []Request, inv *Inventory) ([]int, bool)
+}
+
+// Names of the strategies as given in the network config.
+const (
+	FirstFitName = "first-fit"
+	BestFitName  = "best-fit"
+	SpreadName   = "spread"
+	OptimalName  = "optimal"
+)
+
+// New returns the strategy of the given name; first-fit if name is empty.
+func New(name string) (Placer, error) {
+	switch name {
+	case "", FirstFitName:
+		return FirstFit{}, nil
+	case BestFitName:
+		return BestFit{}, nil
+	case SpreadName:
+		return Spread{}, nil
+	case OptimalName:
+		return Optimal{}, nil
+	default:
+		return nil, fmt.Errorf("unknown placement strategy %q, expected one of %s, %s, %s or %s",
+			name, FirstFitName, BestFitName, SpreadName, OptimalName)
+	}
+}
+
+// Validate checks the constraints of the requests against each other.
+func Validate(requests []Request) error {
+	for i, r := range requests {
+		for _, j := range r.DistinctFrom {
+			if j < 0 || j >= len(requests) {
+				return fmt.Errorf("interface %d: distinct_from refers to interface %d, the pod only requests %d",
+					i, j, len(requests))
+			}
+			if j == i {
+				return fmt.Errorf("interface %d: distinct_from refers to itself", i)
+			}
+			if r.PFName != "" && r.PFName == requests[j].PFName {
+				return fmt.Errorf("interface %d: pinned to %s like interface %d it must be distinct from",
+					i, r.PFName, j)
+			}
+		}
+		if r.MaxTxRate != 0 && r.MaxTxRate < r.MinTxRate {
+			return fmt.Errorf("interface %d: max_tx_rate %d is below min_tx_rate %d", i, r.MaxTxRate, r.MinTxRate)
+		}
+		if r.NUMANode != nil && *r.NUMANode < 0 {
+			return fmt.Errorf("interface %d: invalid numa_node %d", i, *r.NUMANode)
+		}
+		if r.PreferredNUMANode != nil && *r.PreferredNUMANode < 0 {
+			return fmt.Errorf("interface %d: invalid preferred_numa_node %d", i, *r.PreferredNUMANode)
+		}
+	}
+	return nil
+}
+
+// conflicts reports whether the interfaces i and j must be placed on
+// distinct PFs.
+func conflicts(requests []Request, i, j int) bool {
+	if requests[i].AntiAffinityGroup != "" && requests[i].AntiAffinityGroup == requests[j].AntiAffinityGroup {
+		return true
+	}
+	for _, k := range requests[i].DistinctFrom {
+		if k == j {
+			return true
+		}
+	}
+	for _, k := range requests[j].DistinctFrom {
+		if k == i {
+			return true
+		}
+	}
+	return false
+}
+
+// freeTxRate is the bandwidth the PF still has for min tx rates.
+func freeTxRate(pf *rdma_hardware_info.PF, policy Policy) int {
+	return policy.minRateCapacity(pf) - int(pf.UsedTxRate)
+}
+
+// state is a placement in progress. Requests are placed in order, so
+// the interfaces before the one being placed already have a PF.
+type state struct {
+	requests []Request
+	pfs      []rdma_hardware_info.PF
+	numa     []int
+	policy   []Policy
+	// the sum of the max tx rates on every PF, for the max rate cap
+	usedMax    []int
+	placements []int
+	// the PFs some request is pinned to by name
+	pinned map[string]bool
+	// the requests that take part in an anti-affinity constraint
+	antiAffine []bool
+}
+
+// newState copies the usage counters of the PFs so the search can update
+// them; the VF inventory is shared.
+func newState(requests []Request, inv *Inventory) *state {
+	s := &state{
+		requests:   requests,
+		pfs:        make([]rdma_hardware_info.PF, len(inv.pfs)),
+		numa:       make([]int, len(inv.pfs)),
+		policy:     make([]Policy, len(inv.pfs)),
+		usedMax:    make([]int, len(inv.pfs)),
+		placements: make([]int, len(requests)),
+		pinned:     make(map[string]bool),
+		antiAffine: make([]bool, len(requests)),
+	}
+	copy(s.pfs, inv.pfs)
+	for p := range inv.pfs {
+		s.numa[p] = inv.Topology(inv.pfs[p].Name).NUMANode
+		s.policy[p] = inv.Policy(inv.pfs[p].Name)
+		s.usedMax[p] = inv.usedMax[p]
+	}
+
+	for i, r := range requests {
+		if r.PFName != "" {
+			s.pinned[r.PFName] = true
+		}
+		if r.AntiAffinityGroup != "" || len(r.DistinctFrom) > 0 {
+			s.antiAffine[i] = true
+			for _, j := range r.DistinctFrom {
+				if j >= 0 && j < len(requests) {
+					s.antiAffine[j] = true
+				}
+			}
+		}
+	}
+
+	return s
+}
+
+// allowed reports whether request i may be placed on PF p: the PF has a
+// free VF and enough unreserved bandwidth, and no constraint forbids it.
+func (s *state) allowed(i, p int) bool {
+	r := s.requests[i]
+	pf := &s.pfs[p]
+
+	if pf.CapacityVFs <= pf.UsedVFs || s.free(p) < int(r.MinTxRate) {
+		return false
+	}
+	if limit := s.policy[p].maxRateCapacity(pf); limit >= 0 && s.usedMax[p]+maxRate(pf, r.MaxTxRate) > limit {
+		return false
+	}
+	if r.PFName != "" && r.PFName != pf.Name {
+		return false
+	}
+	if r.NUMANode != nil && *r.NUMANode != s.numa[p] {
+		return false
+	}
+	for j := 0; j < i; j++ {
+		if s.placements[j] == p && conflicts(s.requests, i, j) {
+			return false
+		}
+	}
+	return true
+}
+
+// candidates returns every PF request i may be placed on, in PF order.
+func (s *state) candidates(i int) []int {
+	var c []int
+	for p := range s.pfs {
+		if s.allowed(i, p) {
+			c = append(c, p)
+		}
+	}
+	return c
+}
+
+// local reports whether PF p is on the NUMA node request i prefers. Every
+// PF is local to a request without preference.
+func (s *state) local(i, p int) bool {
+	r := s.requests[i]
+	if r.PreferredNUMANode != nil {
+		return s.numa[p] == *r.PreferredNUMANode
+	}
+	if len(r.TopologyHint) == 0 {
+		return true
+	}
+	for _, node := range r.TopologyHint {
+		if s.numa[p] == node {
+			return true
+		}
+	}
+	return false
+}
+
+// preferLocal moves the PFs local to request i to the front of c, keeping
+// the order within local and remote PFs.
+func (s *state) preferLocal(i int, c []int) []int {
+	sort.SliceStable(c, func(a, b int) bool {
+		return s.local(i, c[a]) && !s.local(i, c[b])
+	})
+	return c
+}
+
+// free is the bandwidth PF p still has for min tx rates.
+func (s *state) free(p int) int {
+	return freeTxRate(&s.pfs[p], s.policy[p])
+}
+
+func (s *state) take(i, p int) {
+	s.pfs[p].UsedTxRate += s.requests[i].MinTxRate
+	s.pfs[p].UsedVFs++
+	s.usedMax[p] += maxRate(&s.pfs[p], s.requests[i].MaxTxRate)
+	s.placements[i] = p
+}
+
+func (s *state) release(i, p int) {
+	s.pfs[p].UsedTxRate -= s.requests[i].MinTxRate
+	s.pfs[p].UsedVFs--
+	s.usedMax[p] -= maxRate(&s.pfs[p], s.requests[i].MaxTxRate)
+}
+
+// equivalent reports whether placing request i on PF a or on PF b leads
+// to the same outcome, so that only one of them needs to be searched.
+func (s *state) equivalent(i, a, b int) bool {
+	pa, pb := &s.pfs[a], &s.pfs[b]
+	if pa.CapacityTxRate != pb.CapacityTxRate || pa.UsedTxRate != pb.UsedTxRate ||
+		pa.CapacityVFs != pb.CapacityVFs || pa.UsedVFs != pb.UsedVFs || s.numa[a] != s.numa[b] ||
+		s.policy[a] != s.policy[b] || s.usedMax[a] != s.usedMax[b] {
+		return false
+	}
+	if s.pinned[pa.Name] || s.pinned[pb.Name] {
+		return false
+	}
+	for j := 0; j < i; j++ {
+		if s.antiAffine[j] && (s.placements[j] == a || s.placements[j] == b) {
+			return false
+		}
+	}
+	return true
+}
+
+// equivalentToAny reports whether PF p is equivalent to one of the PFs
+// already tried for request i.
+func (s *state) equivalentToAny(i, p int, tried []int) bool {
+	for _, o := range tried {
+		if s.equivalent(i, p, o) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,442 @@
+package placement
+
+import (
+	"time"
+
+	"github.com/rit-k8s-rdma/rit-k8s-rdma-common/knapsack_pod_placement"
+	"github.com/rit-k8s-rdma/rit-k8s-rdma-common/rdma_hardware_info"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func request(minTxRate uint) Request {
+	return Request{RdmaInterfaceRequest: knapsack_pod_placement.RdmaInterfaceRequest{MinTxRate: minTxRate}}
+}
+
+func pf(name string, usedTxRate, capacityTxRate, usedVFs, capacityVFs uint) rdma_hardware_info.PF {
+	return rdma_hardware_info.PF{
+		Name:           name,
+		UsedTxRate:     usedTxRate,
+		CapacityTxRate: capacityTxRate,
+		UsedVFs:        usedVFs,
+		CapacityVFs:    capacityVFs,
+	}
+}
+
+var _ = Describe("placement strategies", func() {
+	var pfs []rdma_hardware_info.PF
+
+	BeforeEach(func() {
+		pfs = []rdma_hardware_info.PF{
+			pf("pf0", 0, 100, 0, 8),
+			pf("pf1", 60, 100, 0, 8),
+			pf("pf2", 20, 100, 0, 8),
+		}
+	})
+
+	It("knows every strategy by name", func() {
+		for _, name := range []string{"", FirstFitName, BestFitName, SpreadName, OptimalName} {
+			_, err := New(name)
+			Expect(err).NotTo(HaveOccurred())
+		}
+		_, err := New("random")
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("places on the first PF that fits with first-fit", func() {
+		placements, ok := FirstFit{}.Place([]Request{request(30), request(30)}, NewInventory(pfs))
+		Expect(ok).To(BeTrue())
+		Expect(placements).To(Equal([]int{0, 0}))
+	})
+
+	It("places on the fullest PF that fits with best-fit", func() {
+		placements, ok := BestFit{}.Place([]Request{request(30), request(30)}, NewInventory(pfs))
+		Expect(ok).To(BeTrue())
+		Expect(placements).To(Equal([]int{1, 2}))
+	})
+
+	It("places on the emptiest PF with spread", func() {
+		placements, ok := Spread{}.Place([]Request{request(30), request(30)}, NewInventory(pfs))
+		Expect(ok).To(BeTrue())
+		Expect(placements).To(Equal([]int{0, 2}))
+	})
+
+	It("balances the PFs with optimal", func() {
+		placements, ok := Optimal{}.Place([]Request{request(40), request(20)}, NewInventory(pfs))
+		Expect(ok).To(BeTrue())
+		Expect(placements).To(Equal([]int{0, 2}))
+	})
+
+	It("settles for the spread placement when optimal runs out of steps", func() {
+		requests := []Request{request(20), request(40)}
+		spread, _ := Spread{}.Place(requests, NewInventory(pfs))
+		placements, ok := Optimal{MaxSteps: 1}.Place(requests, NewInventory(pfs))
+		Expect(ok).To(BeTrue())
+		Expect(placements).To(Equal(spread))
+	})
+
+	It("places 16 interfaces with optimal within its step budget", func() {
+		requests, inv := benchmarkCase(16)
+		start := time.Now()
+		placements, ok := Optimal{}.Place(requests, inv)
+		Expect(time.Since(start)).To(BeNumerically("<", time.Second))
+		Expect(ok).To(BeTrue())
+		Expect(placements).To(HaveLen(16))
+	})
+
+	It("backtracks when the greedy choice leaves no room", func() {
+		pfs = []rdma_hardware_info.PF{
+			pf("pf0", 0, 100, 0, 8),
+			pf("pf1", 0, 60, 0, 8),
+		}
+		for _, placer := range []Placer{FirstFit{}, BestFit{}, Spread{}, Optimal{}} {
+			placements, ok := placer.Place([]Request{request(60), request(100)}, NewInventory(pfs))
+			Expect(ok).To(BeTrue())
+			Expect(placements).To(Equal([]int{1, 0}))
+		}
+	})
+
+	It("fails without touching the PFs when the requests do not fit", func() {
+		before := append([]rdma_hardware_info.PF{}, pfs...)
+		for _, placer := range []Placer{FirstFit{}, BestFit{}, Spread{}, Optimal{}} {
+			_, ok := placer.Place([]Request{request(90), request(90)}, NewInventory(pfs))
+			Expect(ok).To(BeFalse())
+			Expect(pfs).To(Equal(before))
+		}
+	})
+
+	It("respects the number of free VFs", func() {
+		pfs = []rdma_hardware_info.PF{
+			pf("pf0", 0, 100, 7, 8),
+			pf("pf1", 0, 100, 8, 8),
+		}
+		_, ok := FirstFit{}.Place([]Request{request(0), request(0)}, NewInventory(pfs))
+		Expect(ok).To(BeFalse())
+	})
+})
+
+var _ = Describe("placement constraints", func() {
+	var pfs []rdma_hardware_info.PF
+
+	BeforeEach(func() {
+		pfs = []rdma_hardware_info.PF{
+			pf("pf0", 0, 100, 0, 8),
+			pf("pf1", 0, 100, 0, 8),
+			pf("pf2", 0, 100, 0, 8),
+		}
+	})
+
+	allPlacers := []Placer{FirstFit{}, BestFit{}, Spread{}, Optimal{}}
+
+	It("pins an interface to the PF of the given name", func() {
+		r := request(10)
+		r.PFName = "pf2"
+		for _, placer := range allPlacers {
+			placements, ok := placer.Place([]Request{request(10), r}, NewInventory(pfs))
+			Expect(ok).To(BeTrue())
+			Expect(placements[1]).To(Equal(2))
+		}
+	})
+
+	It("fails when the pinned PF is full", func() {
+		pfs[2].UsedVFs = 8
+		r := request(10)
+		r.PFName = "pf2"
+		for _, placer := range allPlacers {
+			_, ok := placer.Place([]Request{r}, NewInventory(pfs))
+			Expect(ok).To(BeFalse())
+		}
+	})
+
+	It("keeps distinct_from interfaces on different PFs", func() {
+		r := request(10)
+		r.DistinctFrom = []int{0}
+		for _, placer := range allPlacers {
+			placements, ok := placer.Place([]Request{request(10), r}, NewInventory(pfs))
+			Expect(ok).To(BeTrue())
+			Expect(placements[0]).NotTo(Equal(placements[1]))
+		}
+	})
+
+	It("keeps an anti-affinity group on different PFs", func() {
+		requests := []Request{request(10), request(10), request(10)}
+		for i := range requests {
+			requests[i].AntiAffinityGroup = "failover"
+		}
+		for _, placer := range allPlacers {
+			placements, ok := placer.Place(requests, NewInventory(pfs))
+			Expect(ok).To(BeTrue())
+			Expect(placements).To(ConsistOf(0, 1, 2))
+		}
+
+		requests = append(requests, requests[0])
+		for _, placer := range allPlacers {
+			_, ok := placer.Place(requests, NewInventory(pfs))
+			Expect(ok).To(BeFalse())
+		}
+	})
+
+	It("backtracks over a pinned interface placed late", func() {
+		pfs[1].UsedTxRate = 100
+		pfs[2].UsedTxRate = 100
+		pinned := request(0)
+		pinned.PFName = "pf0"
+		pinned.DistinctFrom = []int{0}
+		_, ok := FirstFit{}.Place([]Request{request(0), pinned}, NewInventory(pfs))
+		Expect(ok).To(BeTrue())
+	})
+
+	It("rejects distinct_from entries that do not name another interface", func() {
+		r := request(0)
+		r.DistinctFrom = []int{1}
+		Expect(Validate([]Request{r})).To(HaveOccurred())
+		r.DistinctFrom = []int{0}
+		Expect(Validate([]Request{r})).To(HaveOccurred())
+		Expect(Validate([]Request{request(0), r})).NotTo(HaveOccurred())
+	})
+})
+
+var _ = Describe("placement diagnosis", func() {
+	It("tells why every PF was rejected", func() {
+		pfs := []rdma_hardware_info.PF{
+			pf("pf0", 0, 100, 8, 8),
+			pf("pf1", 80, 100, 0, 8),
+		}
+		d := Diagnose([]Request{request(50)}, NewInventory(pfs))
+		Expect(d.FitIndividually).To(BeFalse())
+		Expect(d.Interfaces).To(HaveLen(1))
+		Expect(d.Interfaces[0].Candidates).To(Equal([]Candidate{
+			{PF: "pf0", Rejection: RejectedNoFreeVFs},
+			{PF: "pf1", Rejection: RejectedBandwidth},
+		}))
+		Expect(d.Remaining).To(Equal([]Capacity{
+			{PF: "pf0", FreeVFs: 0, FreeTxRate: 100, NUMANode: -1},
+			{PF: "pf1", FreeVFs: 8, FreeTxRate: 20, NUMANode: -1},
+		}))
+		Expect(d.String()).To(Equal("eth0 (min_tx_rate=50): rejected by pf0 no free VFs, pf1 not enough bandwidth; " +
+			"remaining: pf0 free_vfs=0 free_tx_rate=100, pf1 free_vfs=8 free_tx_rate=20"))
+	})
+
+	It("tells when the interfaces only fail together", func() {
+		pfs := []rdma_hardware_info.PF{pf("pf0", 0, 100, 0, 8)}
+		pinned := request(60)
+		pinned.PFName = "pf1"
+		d := Diagnose([]Request{request(60), request(60)}, NewInventory(pfs))
+		Expect(d.FitIndividually).To(BeTrue())
+		Expect(d.String()).To(ContainSubstring("every interface fits on its own but not all of them together"))
+
+		d = Diagnose([]Request{pinned}, NewInventory(pfs))
+		Expect(d.Interfaces[0].Candidates[0].Rejection).To(Equal(RejectedPinned))
+	})
+})
+
+var _ = Describe("reservations", func() {
+	var pfs []rdma_hardware_info.PF
+
+	BeforeEach(func() {
+		pfs = []rdma_hardware_info.PF{
+			pf("pf0", 10, 100, 1, 8),
+			pf("pf1", 0, 100, 0, 8),
+		}
+	})
+
+	It("reserves without touching the inventory", func() {
+		inv := NewInventory(pfs)
+		pfs[0].UsedTxRate = 100
+
+		r, d := Reserve(FirstFit{}, []Request{request(30), request(20), request(60)}, inv)
+		Expect(d).To(BeNil())
+		Expect(r.Placements).To(Equal([]int{0, 0, 1}))
+		Expect(r.Deltas).To(Equal([]Delta{
+			{PF: "pf0", TxRate: 50, VFs: 2, MaxTxRate: 200},
+			{PF: "pf1", TxRate: 60, VFs: 1, MaxTxRate: 100},
+		}))
+		Expect(inv.PFs()[0].UsedTxRate).To(Equal(uint(10)))
+
+		after, err := inv.With(r)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(after.PFs()[0].UsedTxRate).To(Equal(uint(60)))
+		Expect(after.PFs()[0].UsedVFs).To(Equal(uint(3)))
+		Expect(inv.PFs()[0].UsedTxRate).To(Equal(uint(10)))
+	})
+
+	It("reverts what it applied", func() {
+		r, _ := Reserve(Spread{}, []Request{request(30), request(20)}, NewInventory(pfs))
+		before := NewInventory(pfs).PFs()
+
+		Expect(r.Apply(pfs)).To(Succeed())
+		Expect(pfs).NotTo(Equal(before))
+		Expect(r.Revert(pfs)).To(Succeed())
+		Expect(pfs).To(Equal(before))
+
+		Expect(r.Revert(pfs)).NotTo(Succeed())
+		Expect(pfs).To(Equal(before))
+		Expect(r.Apply(pfs[:1])).NotTo(Succeed())
+	})
+
+	It("returns a diagnosis when the pod does not fit", func() {
+		r, d := Reserve(FirstFit{}, []Request{request(200)}, NewInventory(pfs))
+		Expect(r).To(BeNil())
+		Expect(d.Interfaces).To(HaveLen(1))
+	})
+})
+
+var _ = Describe("NUMA aware placement", func() {
+	var inv *Inventory
+
+	numaNode := func(node int) *int {
+		return &node
+	}
+
+	BeforeEach(func() {
+		inv = NewInventory([]rdma_hardware_info.PF{
+			pf("pf0", 0, 100, 0, 8),
+			pf("pf1", 0, 100, 0, 8),
+			pf("pf2", 0, 100, 0, 8),
+		}).WithTopology(map[string]Topology{
+			"pf0": {NUMANode: 0},
+			"pf1": {NUMANode: 1},
+			"pf2": {NUMANode: 1},
+		})
+	})
+
+	allPlacers := []Placer{FirstFit{}, BestFit{}, Spread{}, Optimal{}}
+
+	It("only uses PFs on the required NUMA node", func() {
+		r := request(60)
+		r.NUMANode = numaNode(1)
+		for _, placer := range allPlacers {
+			placements, ok := placer.Place([]Request{r, r}, inv)
+			Expect(ok).To(BeTrue())
+			Expect(placements).To(ConsistOf(1, 2))
+
+			_, ok = placer.Place([]Request{r, r, r}, inv)
+			Expect(ok).To(BeFalse())
+		}
+		d := Diagnose([]Request{r}, inv)
+		Expect(d.Interfaces[0].Candidates[0].Rejection).To(Equal(RejectedNUMA))
+	})
+
+	It("prefers PFs on the preferred NUMA node", func() {
+		r := request(60)
+		r.PreferredNUMANode = numaNode(1)
+		for _, placer := range allPlacers {
+			placements, ok := placer.Place([]Request{r}, inv)
+			Expect(ok).To(BeTrue())
+			Expect(placements[0]).NotTo(Equal(0))
+
+			placements, ok = placer.Place([]Request{r, r, r}, inv)
+			Expect(ok).To(BeTrue())
+			Expect(placements).To(ConsistOf(0, 1, 2))
+		}
+	})
+
+	It("follows the Topology Manager hint", func() {
+		r := request(10)
+		r.TopologyHint = []int{0}
+		for _, placer := range allPlacers {
+			placements, ok := placer.Place([]Request{r, r}, inv)
+			Expect(ok).To(BeTrue())
+			Expect(placements).To(Equal([]int{0, 0}))
+		}
+	})
+})
+
+var _ = Describe("bandwidth policies", func() {
+	var pfs []rdma_hardware_info.PF
+
+	rates := func(minTxRate, maxTxRate uint) Request {
+		r := request(minTxRate)
+		r.MaxTxRate = maxTxRate
+		return r
+	}
+
+	BeforeEach(func() {
+		pfs = []rdma_hardware_info.PF{
+			pf("pf0", 50, 100, 0, 8),
+			pf("pf1", 50, 100, 0, 8),
+		}
+	})
+
+	It("guarantees min rates by default", func() {
+		_, ok := FirstFit{}.Place([]Request{request(60)}, NewInventory(pfs))
+		Expect(ok).To(BeFalse())
+	})
+
+	It("oversubscribes min rates by the configured ratio", func() {
+		inv := NewInventory(pfs).WithPolicies(Policy{}, map[string]Policy{
+			"pf1": {MinRateOversubscription: 1.5},
+		})
+		placements, ok := FirstFit{}.Place([]Request{request(60)}, inv)
+		Expect(ok).To(BeTrue())
+		Expect(placements).To(Equal([]int{1}))
+
+		d := Diagnose([]Request{request(60)}, inv)
+		Expect(d.Remaining[1].FreeTxRate).To(Equal(100))
+	})
+
+	It("caps the sum of max rates", func() {
+		pfs[0].VFs = []*rdma_hardware_info.VF{
+			{VFNumber: 0, Allocated: true, MaxTxRate: 80},
+			{VFNumber: 1, Allocated: false, MaxTxRate: 100},
+		}
+		inv := NewInventory(pfs).WithPolicies(Policy{MaxRateCap: 1}, nil)
+
+		placements, ok := FirstFit{}.Place([]Request{rates(0, 20), rates(0, 50)}, inv)
+		Expect(ok).To(BeTrue())
+		Expect(placements).To(Equal([]int{0, 1}))
+
+		// no max rate counts as the whole line rate
+		placements, ok = FirstFit{}.Place([]Request{rates(0, 0)}, inv)
+		Expect(ok).To(BeTrue())
+		Expect(placements).To(Equal([]int{1}))
+		_, ok = FirstFit{}.Place([]Request{rates(0, 0), rates(0, 30)}, inv)
+		Expect(ok).To(BeFalse())
+
+		d := Diagnose([]Request{rates(0, 30)}, inv)
+		Expect(d.Interfaces[0].Candidates[0].Rejection).To(Equal(RejectedMaxRateCap))
+	})
+
+	It("caps the sum of max rates across reservations", func() {
+		inv := NewInventory(pfs).WithPolicies(Policy{MaxRateCap: 1}, nil)
+
+		first, d := Reserve(FirstFit{}, []Request{rates(0, 60)}, inv)
+		Expect(d).To(BeNil())
+		Expect(first.Deltas).To(Equal([]Delta{{PF: "pf0", VFs: 1, MaxTxRate: 60}}))
+		inv, err := inv.With(first)
+		Expect(err).NotTo(HaveOccurred())
+
+		second, d := Reserve(FirstFit{}, []Request{rates(0, 60)}, inv)
+		Expect(d).To(BeNil())
+		Expect(second.Placements).To(Equal([]int{1}))
+		inv, err = inv.With(second)
+		Expect(err).NotTo(HaveOccurred())
+
+		third, d := Reserve(FirstFit{}, []Request{rates(0, 60)}, inv)
+		Expect(third).To(BeNil())
+		Expect(d.Interfaces[0].Candidates[0].Rejection).To(Equal(RejectedMaxRateCap))
+		Expect(d.Interfaces[0].Candidates[1].Rejection).To(Equal(RejectedMaxRateCap))
+
+		inv, err = inv.Without(first)
+		Expect(err).NotTo(HaveOccurred())
+		third, d = Reserve(FirstFit{}, []Request{rates(0, 60)}, inv)
+		Expect(d).To(BeNil())
+		Expect(third.Placements).To(Equal([]int{0}))
+
+		_, err = inv.Without(first)
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("rejects max rates below min rates", func() {
+		Expect(Validate([]Request{rates(50, 20)})).To(HaveOccurred())
+		Expect(Validate([]Request{rates(50, 0)})).To(Succeed())
+		Expect(Validate([]Request{rates(50, 50)})).To(Succeed())
+	})
+
+	It("rejects nonsensical ratios", func() {
+		Expect(Policy{MinRateOversubscription: 0.5}.Validate()).To(HaveOccurred())
+		Expect(Policy{MaxRateCap: -1}.Validate()).To(HaveOccurred())
+		Expect(Policy{MinRateOversubscription: 2, MaxRateCap: 3}.Validate()).To(Succeed())
+	})
+})
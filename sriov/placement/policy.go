@@ -0,0 +1,90 @@
+package placement
+
+import (
+	"fmt"
+
+	"github.com/rit-k8s-rdma/rit-k8s-rdma-common/rdma_hardware_info"
+)
+
+// Policy is how the bandwidth of a PF is shared between interfaces.
+type Policy struct {
+	// MinRateOversubscription is the ratio of the PF capacity the min tx
+	// rates of its interfaces may add up to. 1, the default, guarantees
+	// every min tx rate; above 1 the PF is oversubscribed.
+	MinRateOversubscription float64 `json:"minRateOversubscription,omitempty"`
+	// MaxRateCap, if set, is the ratio of the PF capacity the max tx
+	// rates of its interfaces may add up to. An interface without max
+	// tx rate counts with the full capacity. 0 leaves max rates unchecked.
+	MaxRateCap float64 `json:"maxRateCap,omitempty"`
+}
+
+// Validate checks that the ratios of the policy make sense.
+func (p Policy) Validate() error {
+	if p.MinRateOversubscription != 0 && p.MinRateOversubscription < 1 {
+		return fmt.Errorf("minRateOversubscription %g is below 1", p.MinRateOversubscription)
+	}
+	if p.MaxRateCap < 0 {
+		return fmt.Errorf("maxRateCap %g is negative", p.MaxRateCap)
+	}
+	return nil
+}
+
+// minRateCapacity is the bandwidth the min tx rates of the interfaces on
+// the PF may add up to.
+func (p Policy) minRateCapacity(pf *rdma_hardware_info.PF) int {
+	ratio := p.MinRateOversubscription
+	if ratio == 0 {
+		ratio = 1
+	}
+	return int(float64(pf.CapacityTxRate) * ratio)
+}
+
+// maxRateCapacity is the bandwidth the max tx rates of the interfaces on
+// the PF may add up to, or -1 if they are not capped.
+func (p Policy) maxRateCapacity(pf *rdma_hardware_info.PF) int {
+	if p.MaxRateCap == 0 {
+		return -1
+	}
+	return int(float64(pf.CapacityTxRate) * p.MaxRateCap)
+}
+
+// maxRate is what an interface with the given max tx rate counts against
+// the max rate cap of the PF.
+func maxRate(pf *rdma_hardware_info.PF, maxTxRate uint) int {
+	if maxTxRate == 0 || maxTxRate > pf.CapacityTxRate {
+		return int(pf.CapacityTxRate)
+	}
+	return int(maxTxRate)
+}
+
+// usedMaxRate sums the max tx rates of the allocated VFs of the PF, as the
+// daemon reported them.
+func usedMaxRate(pf *rdma_hardware_info.PF) int {
+	used := 0
+	for _, vf := range pf.VFs {
+		if vf.Allocated {
+			used += maxRate(pf, vf.MaxTxRate)
+		}
+	}
+	return used
+}
+
+// WithPolicies returns the inventory with a policy for every PF: the one
+// named after the PF in perPF, or def.
+func (inv *Inventory) WithPolicies(def Policy, perPF map[string]Policy) *Inventory {
+	c := *inv
+	c.defaultPolicy = def
+	c.policies = make(map[string]Policy, len(perPF))
+	for name, policy := range perPF {
+		c.policies[name] = policy
+	}
+	return &c
+}
+
+// Policy returns the policy of the named PF.
+func (inv *Inventory) Policy(pfName string) Policy {
+	if p, ok := inv.policies[pfName]; ok {
+		return p
+	}
+	return inv.defaultPolicy
+}
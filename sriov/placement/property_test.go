@@ -0,0 +1,220 @@
+package placement
+
+import (
+	"fmt"
+	"math/rand"
+
+	"github.com/rit-k8s-rdma/rit-k8s-rdma-common/knapsack_pod_placement"
+	"github.com/rit-k8s-rdma/rit-k8s-rdma-common/rdma_hardware_info"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// randomCase builds a small random inventory and pod, small enough for
+// the brute force oracle. withConstraints adds pinning, anti-affinity,
+// NUMA and policies to the mix.
+func randomCase(rng *rand.Rand, withConstraints bool) ([]Request, *Inventory) {
+	rates := []uint{0, 10, 25, 40, 50, 100}
+
+	pfs := make([]rdma_hardware_info.PF, 1+rng.Intn(4))
+	topology := make(map[string]Topology)
+	policies := make(map[string]Policy)
+	for i := range pfs {
+		capacity := rates[rng.Intn(len(rates))]
+		capacityVFs := uint(rng.Intn(4))
+		pfs[i] = rdma_hardware_info.PF{
+			Name:           fmt.Sprintf("pf%d", i),
+			CapacityTxRate: capacity,
+			UsedTxRate:     uint(rng.Intn(int(capacity) + 1)),
+			CapacityVFs:    capacityVFs,
+			UsedVFs:        uint(rng.Intn(int(capacityVFs) + 1)),
+		}
+		if withConstraints {
+			topology[pfs[i].Name] = Topology{NUMANode: rng.Intn(2)}
+			if rng.Intn(3) == 0 {
+				policies[pfs[i].Name] = Policy{
+					MinRateOversubscription: 1 + float64(rng.Intn(3))/2,
+					MaxRateCap:              float64(rng.Intn(3)),
+				}
+			}
+		}
+	}
+
+	requests := make([]Request, rng.Intn(6))
+	for i := range requests {
+		requests[i].MinTxRate = rates[rng.Intn(len(rates))] / 2
+		if rng.Intn(2) == 0 {
+			requests[i].MaxTxRate = requests[i].MinTxRate + uint(rng.Intn(50))
+		}
+		if !withConstraints {
+			continue
+		}
+		switch rng.Intn(8) {
+		case 0:
+			requests[i].PFName = pfs[rng.Intn(len(pfs))].Name
+		case 1:
+			if i > 0 {
+				requests[i].DistinctFrom = []int{rng.Intn(i)}
+			}
+		case 2:
+			requests[i].AntiAffinityGroup = "group"
+		case 3:
+			node := rng.Intn(2)
+			requests[i].NUMANode = &node
+		case 4:
+			node := rng.Intn(2)
+			requests[i].PreferredNUMANode = &node
+		}
+	}
+
+	return requests, NewInventory(pfs).WithTopology(topology).WithPolicies(Policy{}, policies)
+}
+
+// checkPlacement verifies a complete placement against the inventory
+// without going through the search code.
+func checkPlacement(requests []Request, inv *Inventory, placements []int) error {
+	if len(placements) != len(requests) {
+		return fmt.Errorf("%d placements for %d requests", len(placements), len(requests))
+	}
+
+	pfs := inv.PFs()
+	minRates := make([]uint, len(pfs))
+	maxRates := make([]uint, len(pfs))
+	vfs := make([]uint, len(pfs))
+	for i, p := range placements {
+		if p < 0 || p >= len(pfs) {
+			return fmt.Errorf("interface %d placed on PF %d of %d", i, p, len(pfs))
+		}
+		r := requests[i]
+		minRates[p] += r.MinTxRate
+		if r.MaxTxRate == 0 || r.MaxTxRate > pfs[p].CapacityTxRate {
+			maxRates[p] += pfs[p].CapacityTxRate
+		} else {
+			maxRates[p] += r.MaxTxRate
+		}
+		vfs[p]++
+
+		if r.PFName != "" && r.PFName != pfs[p].Name {
+			return fmt.Errorf("interface %d pinned to %s placed on %s", i, r.PFName, pfs[p].Name)
+		}
+		if r.NUMANode != nil && *r.NUMANode != inv.Topology(pfs[p].Name).NUMANode {
+			return fmt.Errorf("interface %d placed off its NUMA node", i)
+		}
+		for j := range requests {
+			if j != i && placements[j] == p && conflicts(requests, i, j) {
+				return fmt.Errorf("interfaces %d and %d share %s", i, j, pfs[p].Name)
+			}
+		}
+	}
+
+	for p, pf := range pfs {
+		if vfs[p] == 0 {
+			continue
+		}
+		policy := inv.Policy(pf.Name)
+		if pf.UsedVFs+vfs[p] > pf.CapacityVFs {
+			return fmt.Errorf("%s over VF capacity", pf.Name)
+		}
+		ratio := policy.MinRateOversubscription
+		if ratio == 0 {
+			ratio = 1
+		}
+		if float64(pf.UsedTxRate+minRates[p]) > float64(pf.CapacityTxRate)*ratio {
+			return fmt.Errorf("%s over bandwidth capacity", pf.Name)
+		}
+		if policy.MaxRateCap > 0 && float64(maxRates[p]) > float64(pf.CapacityTxRate)*policy.MaxRateCap {
+			return fmt.Errorf("%s over max rate cap", pf.Name)
+		}
+	}
+
+	return nil
+}
+
+// oracle tries every placement and returns the best one by the measure
+// of Optimal, or nil if there is none.
+func oracle(requests []Request, inv *Inventory) []int {
+	pfs := inv.PFs()
+	var best []int
+	bestRemote, bestScore := 0, 0.0
+
+	placements := make([]int, len(requests))
+	var enumerate func(i int)
+	enumerate = func(i int) {
+		if i < len(requests) {
+			for p := range pfs {
+				placements[i] = p
+				enumerate(i + 1)
+			}
+			return
+		}
+		if checkPlacement(requests, inv, placements) != nil {
+			return
+		}
+		remote, score := scorePlacement(BalancedScore, requests, inv, placements)
+		if best == nil || remote < bestRemote || (remote == bestRemote && score < bestScore-1e-9) {
+			best = append([]int{}, placements...)
+			bestRemote, bestScore = remote, score
+		}
+	}
+	enumerate(0)
+
+	return best
+}
+
+var _ = Describe("placement properties", func() {
+	allPlacers := map[string]Placer{
+		FirstFitName: FirstFit{},
+		BestFitName:  BestFit{},
+		SpreadName:   Spread{},
+		OptimalName:  Optimal{},
+	}
+
+	for _, withConstraints := range []bool{false, true} {
+		withConstraints := withConstraints
+
+		It(fmt.Sprintf("agrees with the brute force oracle (constraints: %v)", withConstraints), func() {
+			rng := rand.New(rand.NewSource(1))
+			for n := 0; n < 2000; n++ {
+				requests, inv := randomCase(rng, withConstraints)
+				before := inv.PFs()
+				expected := oracle(requests, inv)
+
+				for name, placer := range allPlacers {
+					placements, ok := placer.Place(requests, inv)
+					Expect(ok).To(Equal(expected != nil), "%s on case %d", name, n)
+					Expect(inv.PFs()).To(Equal(before), "%s on case %d", name, n)
+					if !ok {
+						Expect(placements).To(BeEmpty())
+						continue
+					}
+					Expect(checkPlacement(requests, inv, placements)).To(Succeed(), "%s on case %d", name, n)
+				}
+
+				if expected != nil {
+					placements, _ := Optimal{}.Place(requests, inv)
+					remote, score := scorePlacement(BalancedScore, requests, inv, placements)
+					bestRemote, bestScore := scorePlacement(BalancedScore, requests, inv, expected)
+					Expect(remote).To(Equal(bestRemote), "case %d", n)
+					Expect(score).To(BeNumerically("~", bestScore, 1e-9), "case %d", n)
+				}
+			}
+		})
+	}
+
+	It("finds the same pods placeable as PlacePod", func() {
+		rng := rand.New(rand.NewSource(2))
+		for n := 0; n < 2000; n++ {
+			requests, inv := randomCase(rng, false)
+			knapsackRequests := make([]knapsack_pod_placement.RdmaInterfaceRequest, len(requests))
+			for i := range requests {
+				knapsackRequests[i] = requests[i].RdmaInterfaceRequest
+			}
+
+			expected, expectedOk := knapsack_pod_placement.PlacePod(knapsackRequests, inv.PFs(), false)
+			placements, ok := FirstFit{}.Place(requests, inv)
+			Expect(ok).To(Equal(expectedOk), "case %d", n)
+			Expect(placements).To(Equal(expected), "case %d", n)
+		}
+	})
+})
@@ -0,0 +1,195 @@
+package placement
+
+import (
+	"fmt"
+
+	"github.com/rit-k8s-rdma/rit-k8s-rdma-common/rdma_hardware_info"
+)
+
+// Inventory is an immutable snapshot of the PFs of a node, as reported by
+// the RDMA hardware daemon, and of where they sit in the node.
+type Inventory struct {
+	pfs []rdma_hardware_info.PF
+	// the sum of the max tx rates on every PF, for the max rate cap. The
+	// PFs only count min rates, so reservations are tracked here.
+	usedMax       []int
+	topology      map[string]Topology
+	defaultPolicy Policy
+	policies      map[string]Policy
+}
+
+// NewInventory takes a snapshot of pfs; later changes to pfs do not show
+// in the inventory.
+func NewInventory(pfs []rdma_hardware_info.PF) *Inventory {
+	inv := &Inventory{pfs: copyPFs(pfs), usedMax: make([]int, len(pfs))}
+	for p := range inv.pfs {
+		inv.usedMax[p] = usedMaxRate(&inv.pfs[p])
+	}
+	return inv
+}
+
+// PFs returns a copy of the PFs of the inventory.
+func (inv *Inventory) PFs() []rdma_hardware_info.PF {
+	return copyPFs(inv.pfs)
+}
+
+// With returns the inventory that results from applying r.
+func (inv *Inventory) With(r *Reservation) (*Inventory, error) {
+	c := inv.copy()
+	if err := r.Apply(c.pfs); err != nil {
+		return nil, err
+	}
+	idx, _ := r.match(c.pfs)
+	for i, d := range r.Deltas {
+		c.usedMax[idx[i]] += int(d.MaxTxRate)
+	}
+	return c, nil
+}
+
+// Without returns the inventory that results from reverting r.
+func (inv *Inventory) Without(r *Reservation) (*Inventory, error) {
+	c := inv.copy()
+	idx, err := r.match(c.pfs)
+	if err != nil {
+		return nil, err
+	}
+	for i, d := range r.Deltas {
+		if c.usedMax[idx[i]] < int(d.MaxTxRate) {
+			return nil, fmt.Errorf("%s uses %d Mbps of max rates, less than the reserved %d Mbps",
+				d.PF, c.usedMax[idx[i]], d.MaxTxRate)
+		}
+	}
+	if err = r.Revert(c.pfs); err != nil {
+		return nil, err
+	}
+	for i, d := range r.Deltas {
+		c.usedMax[idx[i]] -= int(d.MaxTxRate)
+	}
+	return c, nil
+}
+
+// copy returns the inventory with its own usage counters.
+func (inv *Inventory) copy() *Inventory {
+	c := *inv
+	c.pfs = copyPFs(inv.pfs)
+	c.usedMax = append([]int(nil), inv.usedMax...)
+	return &c
+}
+
+func copyPFs(pfs []rdma_hardware_info.PF) []rdma_hardware_info.PF {
+	c := make([]rdma_hardware_info.PF, len(pfs))
+	for i, pf := range pfs {
+		c[i] = pf
+		if pf.VFs == nil {
+			continue
+		}
+		c[i].VFs = make([]*rdma_hardware_info.VF, len(pf.VFs))
+		for j, vf := range pf.VFs {
+			vfCopy := *vf
+			c[i].VFs[j] = &vfCopy
+		}
+	}
+	return c
+}
+
+// Delta is what a reservation takes from one PF.
+type Delta struct {
+	PF     string
+	TxRate uint
+	VFs    uint
+	// MaxTxRate is what the interfaces count against the max rate cap of
+	// the PF; an interface without max tx rate counts with the capacity.
+	MaxTxRate uint
+}
+
+// Reservation is a placement of the interfaces of a pod on an inventory.
+type Reservation struct {
+	// Placements holds for every request the index of its PF in the
+	// inventory.
+	Placements []int
+	// Deltas holds one entry per PF the pod uses, in inventory order.
+	Deltas []Delta
+}
+
+// Reserve places the requests on the inventory with the placer. If they
+// do not fit, the reservation is nil and the diagnosis tells why.
+func Reserve(placer Placer, requests []Request, inv *Inventory) (*Reservation, *Diagnosis) {
+	placements, ok := placer.Place(requests, inv)
+	if !ok {
+		return nil, Diagnose(requests, inv)
+	}
+
+	deltas := make([]*Delta, len(inv.pfs))
+	for i, p := range placements {
+		if deltas[p] == nil {
+			deltas[p] = &Delta{PF: inv.pfs[p].Name}
+		}
+		deltas[p].TxRate += requests[i].MinTxRate
+		deltas[p].VFs++
+		deltas[p].MaxTxRate += uint(maxRate(&inv.pfs[p], requests[i].MaxTxRate))
+	}
+
+	r := &Reservation{Placements: placements}
+	for _, d := range deltas {
+		if d != nil {
+			r.Deltas = append(r.Deltas, *d)
+		}
+	}
+	return r, nil
+}
+
+// Apply adds the reservation to the usage of pfs, which are matched by
+// name. Nothing is changed if one of the PFs is missing. A PF has no
+// counter for max rates, so the max rate deltas are only applied by
+// Inventory.With.
+func (r *Reservation) Apply(pfs []rdma_hardware_info.PF) error {
+	idx, err := r.match(pfs)
+	if err != nil {
+		return err
+	}
+	for i, d := range r.Deltas {
+		pfs[idx[i]].UsedTxRate += d.TxRate
+		pfs[idx[i]].UsedVFs += d.VFs
+	}
+	return nil
+}
+
+// Revert takes the reservation back from the usage of pfs. Nothing is
+// changed if one of the PFs is missing or uses less than was reserved.
+// Inventory.Without also reverts the max rate deltas.
+func (r *Reservation) Revert(pfs []rdma_hardware_info.PF) error {
+	idx, err := r.match(pfs)
+	if err != nil {
+		return err
+	}
+	for i, d := range r.Deltas {
+		pf := &pfs[idx[i]]
+		if pf.UsedTxRate < d.TxRate || pf.UsedVFs < d.VFs {
+			return fmt.Errorf("%s uses %d Mbps and %d VFs, less than the reserved %d Mbps and %d VFs",
+				pf.Name, pf.UsedTxRate, pf.UsedVFs, d.TxRate, d.VFs)
+		}
+	}
+	for i, d := range r.Deltas {
+		pfs[idx[i]].UsedTxRate -= d.TxRate
+		pfs[idx[i]].UsedVFs -= d.VFs
+	}
+	return nil
+}
+
+// match returns the index in pfs of the PF of every delta.
+func (r *Reservation) match(pfs []rdma_hardware_info.PF) ([]int, error) {
+	idx := make([]int, len(r.Deltas))
+	for i, d := range r.Deltas {
+		idx[i] = -1
+		for p := range pfs {
+			if pfs[p].Name == d.PF {
+				idx[i] = p
+				break
+			}
+		}
+		if idx[i] < 0 {
+			return nil, fmt.Errorf("PF %s of the reservation not found", d.PF)
+		}
+	}
+	return idx, nil
+}
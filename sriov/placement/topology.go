@@ -0,0 +1,32 @@
+package placement
+
+// Topology is where a PF sits in the node. The hardware daemon does not
+// report it, so it is read from sysfs on the node itself.
+type Topology struct {
+	// NUMANode is the NUMA node the PF is attached to, or -1 if the
+	// platform does not tell.
+	NUMANode int
+}
+
+// unknownTopology is the topology of PFs nothing is known about.
+var unknownTopology = Topology{NUMANode: -1}
+
+// WithTopology returns the inventory with the topology of its PFs, keyed
+// by PF name.
+func (inv *Inventory) WithTopology(topology map[string]Topology) *Inventory {
+	t := make(map[string]Topology, len(topology))
+	for name, pfTopology := range topology {
+		t[name] = pfTopology
+	}
+	c := *inv
+	c.topology = t
+	return &c
+}
+
+// Topology returns the topology of the named PF.
+func (inv *Inventory) Topology(pfName string) Topology {
+	if t, ok := inv.topology[pfName]; ok {
+		return t
+	}
+	return unknownTopology
+}
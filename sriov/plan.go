@@ -0,0 +1,118 @@
+package main
+
+import (
+	"github.com/rit-k8s-rdma/rit-k8s-rdma-common/rdma_hardware_info"
+	"github.com/rit-k8s-rdma/rit-k8s-rdma-sriov-cni/sriov/placement"
+)
+
+// vfAssignment is the concrete VF a pod interface is set up on.
+type vfAssignment struct {
+	PFName string
+	VF     int
+}
+
+// resolvePciAddresses turns the pci_address of every request into the PF
+// name placement works with. It returns the VF every request is pinned
+// to, or -1 if the address is the one of a PF or none was given.
+func resolvePciAddresses(requests []placement.Request) ([]int, error) {
+	requestedVfs := make([]int, len(requests))
+
+	for i := range requests {
+		r := &requests[i]
+		requestedVfs[i] = -1
+		if r.PCIAddress == "" {
+			continue
+		}
+
+		pfName, vfIdx, err := getVfByPciAddress(r.PCIAddress)
+		if err != nil {
+			// not a VF, the address may be the one of a PF
+			pfName, err = getPfByPciAddress(r.PCIAddress)
+			if err != nil {
+				return nil, newError(errCodeInvalidPodRequirements, "invalid rdma_interfaces_required annotation",
+					"interface %d: pci_address %q is neither a VF nor a PF: %v", i, r.PCIAddress, err)
+			}
+			vfIdx = -1
+		}
+		if r.PFName != "" && r.PFName != pfName {
+			return nil, newError(errCodeInvalidPodRequirements, "invalid rdma_interfaces_required annotation",
+				"interface %d: pci_address %q belongs to %s, not to pf_name %s", i, r.PCIAddress, pfName, r.PFName)
+		}
+
+		r.PFName = pfName
+		requestedVfs[i] = vfIdx
+	}
+
+	return requestedVfs, nil
+}
+
+// planVFs turns the PF placement of every pod interface into a concrete
+// VF from the hardware daemon's inventory. A VF is only taken if the
+// daemon reports it unallocated, and at most once per pod. Interfaces
+// pinned to a VF through requestedVfs get that VF, provided the daemon
+// reports it and it is free; pinned VFs are reserved before the other
+// interfaces get the lowest free VF of their PF.
+func planVFs(placements []int, pfs []rdma_hardware_info.PF, requestedVfs []int) ([]vfAssignment, error) {
+	taken := make(map[string]map[int]bool)
+	for _, pf := range pfs {
+		taken[pf.Name] = make(map[int]bool)
+	}
+	plan := make([]vfAssignment, len(placements))
+
+	for i, placement := range placements {
+		vfIdx := requestedVfs[i]
+		if vfIdx < 0 {
+			continue
+		}
+
+		pf := &pfs[placement]
+		known := false
+		for _, vf := range pf.VFs {
+			if int(vf.VFNumber) != vfIdx {
+				continue
+			}
+			if vf.Allocated {
+				return nil, newError(errCodeVfUnavailable, "VF no longer free",
+					"vf %d of %s requested for eth%d is already allocated", vfIdx, pf.Name, i)
+			}
+			known = true
+		}
+		if !known {
+			return nil, newError(errCodeVfUnavailable, "VF no longer free",
+				"vf %d of %s requested for eth%d is not reported by the RDMA hardware daemon", vfIdx, pf.Name, i)
+		}
+		if taken[pf.Name][vfIdx] {
+			return nil, newError(errCodeInvalidPodRequirements, "invalid rdma_interfaces_required annotation",
+				"vf %d of %s is requested for more than one interface", vfIdx, pf.Name)
+		}
+
+		taken[pf.Name][vfIdx] = true
+		plan[i] = vfAssignment{PFName: pf.Name, VF: vfIdx}
+	}
+
+	for i, placement := range placements {
+		if requestedVfs[i] >= 0 {
+			continue
+		}
+
+		pf := &pfs[placement]
+		vfIdx := -1
+		for _, vf := range pf.VFs {
+			if vf.Allocated || taken[pf.Name][int(vf.VFNumber)] {
+				continue
+			}
+			if vfIdx < 0 || int(vf.VFNumber) < vfIdx {
+				vfIdx = int(vf.VFNumber)
+			}
+		}
+		if vfIdx < 0 {
+			return nil, newError(errCodeInsufficientRdmaResources, "insufficient RDMA bandwidth",
+				"%s was chosen for eth%d but has no unallocated VF left (%s)", pf.Name, i, describePFs(pfs))
+		}
+
+		taken[pf.Name][vfIdx] = true
+		plan[i] = vfAssignment{PFName: pf.Name, VF: vfIdx}
+	}
+
+	return plan, nil
+}
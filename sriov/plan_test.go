@@ -0,0 +1,187 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/rit-k8s-rdma/rit-k8s-rdma-common/rdma_hardware_info"
+
+	"github.com/rit-k8s-rdma/rit-k8s-rdma-sriov-cni/sriov/placement"
+)
+
+// withPciDevices builds a sysfs tree in a temporary directory with the PF
+// 0000:03:00.0 (ens1f0) and its VFs 0000:03:00.<vf+1>, and points
+// sysBusPciDir at it for the duration of a test.
+func withPciDevices(t *testing.T, numVfs int) func() {
+	dir := tempDir(t)
+	devices := filepath.Join(dir, "devices")
+	mkdir := func(path string) {
+		if err := os.MkdirAll(path, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	symlink := func(target, path string) {
+		if err := os.Symlink(target, path); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	pf := "0000:03:00.0"
+	mkdir(filepath.Join(devices, pf, "net", "ens1f0"))
+	for vf := 0; vf < numVfs; vf++ {
+		vfAddr := fmt.Sprintf("0000:03:00.%d", vf+1)
+		mkdir(filepath.Join(devices, vfAddr, "net", fmt.Sprintf("ens1f0v%d", vf)))
+		symlink("../"+pf, filepath.Join(devices, vfAddr, "physfn"))
+		symlink("../"+vfAddr, filepath.Join(devices, pf, fmt.Sprintf("virtfn%d", vf)))
+	}
+
+	orig := sysBusPciDir
+	sysBusPciDir = dir
+	return func() {
+		sysBusPciDir = orig
+		os.RemoveAll(dir)
+	}
+}
+
+func TestResolvePciAddresses(t *testing.T) {
+	defer withPciDevices(t, 3)()
+
+	cases := []struct {
+		name      string
+		requests  []placement.Request
+		pfNames   []string
+		vfs       []int
+		errorCode uint
+	}{
+		{
+			name:     "no address",
+			requests: []placement.Request{{}, {PFName: "ens1f1"}},
+			pfNames:  []string{"", "ens1f1"},
+			vfs:      []int{-1, -1},
+		},
+		{
+			name:     "VF addresses",
+			requests: []placement.Request{{PCIAddress: "0000:03:00.3"}, {PCIAddress: "0000:03:00.1", PFName: "ens1f0"}},
+			pfNames:  []string{"ens1f0", "ens1f0"},
+			vfs:      []int{2, 0},
+		},
+		{
+			name:     "PF address",
+			requests: []placement.Request{{PCIAddress: "0000:03:00.0"}},
+			pfNames:  []string{"ens1f0"},
+			vfs:      []int{-1},
+		},
+		{
+			name:      "missing address",
+			requests:  []placement.Request{{PCIAddress: "0000:81:00.1"}},
+			errorCode: errCodeInvalidPodRequirements,
+		},
+		{
+			name:      "address of another PF",
+			requests:  []placement.Request{{PCIAddress: "0000:03:00.2", PFName: "ens1f1"}},
+			errorCode: errCodeInvalidPodRequirements,
+		},
+	}
+
+	for _, c := range cases {
+		vfs, err := resolvePciAddresses(c.requests)
+		if c.errorCode != 0 {
+			if cniErr, ok := err.(*types.Error); !ok || cniErr.Code != c.errorCode {
+				t.Errorf("%s: error %v, want code %d", c.name, err, c.errorCode)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+		var pfNames []string
+		for _, r := range c.requests {
+			pfNames = append(pfNames, r.PFName)
+		}
+		if !reflect.DeepEqual(pfNames, c.pfNames) || !reflect.DeepEqual(vfs, c.vfs) {
+			t.Errorf("%s: resolved to %v %v, want %v %v", c.name, pfNames, vfs, c.pfNames, c.vfs)
+		}
+	}
+}
+
+func testPF(name string, allocated ...bool) rdma_hardware_info.PF {
+	pf := rdma_hardware_info.PF{Name: name}
+	for i, a := range allocated {
+		pf.VFs = append(pf.VFs, &rdma_hardware_info.VF{VFNumber: uint(i), Allocated: a})
+	}
+	return pf
+}
+
+func TestPlanVFs(t *testing.T) {
+	pfs := []rdma_hardware_info.PF{
+		testPF("ens1f0", true, false, false),
+		testPF("ens1f1", false),
+	}
+
+	cases := []struct {
+		name         string
+		placements   []int
+		requestedVfs []int
+		plan         []vfAssignment
+		errorCode    uint
+	}{
+		{
+			name:         "lowest free VFs",
+			placements:   []int{0, 1, 0},
+			requestedVfs: []int{-1, -1, -1},
+			plan:         []vfAssignment{{"ens1f0", 1}, {"ens1f1", 0}, {"ens1f0", 2}},
+		},
+		{
+			name:         "pinned VF",
+			placements:   []int{0, 0},
+			requestedVfs: []int{-1, 1},
+			plan:         []vfAssignment{{"ens1f0", 2}, {"ens1f0", 1}},
+		},
+		{
+			name:         "pinned VF already allocated",
+			placements:   []int{0},
+			requestedVfs: []int{0},
+			errorCode:    errCodeVfUnavailable,
+		},
+		{
+			name:         "pinned VF unknown to the daemon",
+			placements:   []int{1},
+			requestedVfs: []int{5},
+			errorCode:    errCodeVfUnavailable,
+		},
+		{
+			name:         "VF pinned twice",
+			placements:   []int{0, 0},
+			requestedVfs: []int{1, 1},
+			errorCode:    errCodeInvalidPodRequirements,
+		},
+		{
+			name:         "no free VF left",
+			placements:   []int{1, 1},
+			requestedVfs: []int{-1, -1},
+			errorCode:    errCodeInsufficientRdmaResources,
+		},
+	}
+
+	for _, c := range cases {
+		plan, err := planVFs(c.placements, pfs, c.requestedVfs)
+		if c.errorCode != 0 {
+			if cniErr, ok := err.(*types.Error); !ok || cniErr.Code != c.errorCode {
+				t.Errorf("%s: error %v, want code %d", c.name, err, c.errorCode)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(plan, c.plan) {
+			t.Errorf("%s: planned %v, want %v", c.name, plan, c.plan)
+		}
+	}
+}
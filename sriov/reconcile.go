@@ -0,0 +1,321 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/containernetworking/cni/pkg/ns"
+	"github.com/vishvananda/netlink"
+)
+
+// temporaryVFName matches the names a VF netdev is given in passing: devN
+// while it is taken out of a pod netns, sriovNNNN while it is moved into
+// one in place of eth0. A VF left with such a name was abandoned half way.
+var temporaryVFName = regexp.MustCompile(`^(dev[0-9]+|sriov[0-9]{1,4})$`)
+
+// defaultCNIPath is where the IPAM plugins are looked up when reconcile
+// runs outside of the runtime, which sets CNI_PATH for ADD and DEL.
+const defaultCNIPath = "/opt/cni/bin"
+
+// reconcileAction is one change reconcile makes to the node.
+type reconcileAction struct {
+	description string
+	apply       func() error
+}
+
+// reconcileMain runs `sriov reconcile`. It releases the VFs recorded for
+// containers whose netns is gone, which happens when DEL never ran or
+// failed for good, and resets the VFs of pods set up before the ledger
+// existed that are back in the host netns but still carry their VLAN or
+// rates.
+func reconcileMain(args []string) {
+	flags := flag.NewFlagSet("reconcile", flag.ExitOnError)
+	netconfPath := flags.String("netconf", "",
+		"network configuration the plugin runs with; gives cniDir and dpdk_tool")
+	dryRun := flags.Bool("dry-run", false, "print the planned changes without making them")
+	flags.Parse(args)
+
+	conf := &NetConf{CNIDir: defaultCNIDir}
+	if *netconfPath != "" {
+		netconf, err := ioutil.ReadFile(*netconfPath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to read the network configuration: %v\n", err)
+			os.Exit(1)
+		}
+		if conf, err = loadConf(netconf); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
+		}
+	}
+	if os.Getenv("CNI_PATH") == "" {
+		os.Setenv("CNI_PATH", defaultCNIPath)
+	}
+
+	if err := reconcile(conf, *dryRun, os.Stdout); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+}
+
+// reconcile plans the changes and, unless dryRun, makes them, reporting
+// every change to out. Changes are made under the node lock so that no
+// ADD or DEL runs meanwhile.
+func reconcile(conf *NetConf, dryRun bool, out io.Writer) error {
+	if !dryRun {
+		lock, err := acquireNodeLock("reconcile", "", conf.lockTimeout)
+		if err != nil {
+			return err
+		}
+		defer lock.release()
+	}
+
+	state, err := readReconcileState(conf)
+	if err != nil {
+		return err
+	}
+	actions, notes := planReconcile(conf, state)
+	for _, note := range notes {
+		fmt.Fprintln(out, note)
+	}
+	if len(actions) == 0 {
+		fmt.Fprintln(out, "nothing to reconcile")
+		return nil
+	}
+
+	failed := 0
+	for _, action := range actions {
+		if dryRun {
+			fmt.Fprintf(out, "would %s\n", action.description)
+			continue
+		}
+		fmt.Fprintln(out, action.description)
+		if err = action.apply(); err != nil {
+			fmt.Fprintf(out, "  failed: %v\n", err)
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d changes failed", failed, len(actions))
+	}
+	return nil
+}
+
+// reconcileState is what reconcile knows about the node: what the plugin
+// recorded in its cniDir and the VFs of the PFs the RDMA hardware daemon
+// manages. It is gathered by readReconcileState and planned from by
+// planReconcile.
+type reconcileState struct {
+	ledgers []*podLedger
+	// container IDs of the ledgers whose netns still exists
+	live map[string]bool
+	// netconfs saved for pod interfaces, in cniDir order
+	saved []*savedNetConf
+	// VFs of the RDMA PFs, by PCI address
+	vfs map[string]*hostVF
+}
+
+// savedNetConf is the netconf setupVF saved for a pod interface.
+type savedNetConf struct {
+	containerID string
+	conf        *NetConf
+}
+
+// hostVF is the live configuration of a VF and its netdevs in the host
+// netns, none when it is in a pod netns or bound to a userspace driver.
+type hostVF struct {
+	pfName string
+	config vfConfig
+	names  []string
+}
+
+// readReconcileState gathers the state of the node. Only the PFs reported
+// by the RDMA hardware daemon are looked at, other SR-IOV PFs are none of
+// the plugin's business.
+func readReconcileState(conf *NetConf) (*reconcileState, error) {
+	ledgers, err := listLedgers(conf.CNIDir)
+	if err != nil {
+		return nil, err
+	}
+	state := &reconcileState{
+		ledgers: ledgers,
+		live:    make(map[string]bool),
+		vfs:     make(map[string]*hostVF),
+	}
+	for _, l := range ledgers {
+		if containerExists(l.Netns) {
+			state.live[l.ContainerID] = true
+		}
+	}
+
+	if state.saved, err = listSavedNetConfs(conf.CNIDir); err != nil {
+		return nil, err
+	}
+
+	pfs, err := queryNodePFs()
+	if err != nil {
+		return nil, fmt.Errorf("could not determine what RDMA hardware resources are available: %v", err)
+	}
+	for _, pf := range pfs {
+		pfLink, err := netlink.LinkByName(pf.Name)
+		if err != nil {
+			return nil, fmt.Errorf("failed to lookup PF %q: %v", pf.Name, err)
+		}
+		configs, err := getVfConfigs(pfLink)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the VFs of %s: %v", pf.Name, err)
+		}
+		for _, c := range configs {
+			pciAddr, err := getpciaddress(pf.Name, c.VF)
+			if err != nil {
+				continue
+			}
+			names, err := hostVFNames(pciAddr)
+			if err != nil {
+				return nil, err
+			}
+			state.vfs[pciAddr] = &hostVF{pfName: pf.Name, config: c, names: names}
+		}
+	}
+
+	return state, nil
+}
+
+// listSavedNetConfs reads the netconfs setupVF saved as <cid>-<ifname> in
+// dataDir. Files that are not such a netconf are skipped.
+func listSavedNetConfs(dataDir string) ([]*savedNetConf, error) {
+	paths, err := filepath.Glob(filepath.Join(dataDir, "*-*"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list container data in %q: %v", dataDir, err)
+	}
+
+	var saved []*savedNetConf
+	for _, path := range paths {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		nf := &NetConf{}
+		if err = json.Unmarshal(data, nf); err != nil || nf.DPDKConf.PCIaddr == "" {
+			continue
+		}
+		suffix := "-" + nf.DPDKConf.Ifname
+		if nf.DPDKConf.Ifname == "" || !strings.HasSuffix(filepath.Base(path), suffix) {
+			continue
+		}
+		saved = append(saved, &savedNetConf{
+			containerID: strings.TrimSuffix(filepath.Base(path), suffix),
+			conf:        nf,
+		})
+	}
+	return saved, nil
+}
+
+// planReconcile works out the changes to make from the state of the node.
+// Only VFs the plugin has a record of are touched: the ledgers of gone
+// containers are released like DEL would, which restores the names the
+// VFs had before ADD. A VF known only from the netconf saved by a version
+// of the plugin without the ledger gets its VLAN and rates reset once it
+// is back in the host netns; its original name was never recorded, so a
+// temporary name it still carries is only reported in the returned notes.
+func planReconcile(conf *NetConf, state *reconcileState) ([]reconcileAction, []string) {
+	var actions []reconcileAction
+	var notes []string
+
+	// VFs that are accounted for by a ledger, by PCI address
+	owned := make(map[string]bool)
+	ledgered := make(map[string]bool)
+	for _, l := range state.ledgers {
+		ledgered[l.ContainerID] = true
+		for _, a := range l.Allocations {
+			if !a.VFReleased {
+				owned[a.PCIAddr] = true
+			}
+		}
+		if state.live[l.ContainerID] {
+			continue
+		}
+
+		l := l
+		actions = append(actions, reconcileAction{
+			description: fmt.Sprintf("release %s of container %s", describeLedger(l), l.ContainerID),
+			apply: func() error {
+				return releaseLedger(conf, l, "")
+			},
+		})
+	}
+
+	for _, saved := range state.saved {
+		nf := saved.conf
+		pciAddr := nf.DPDKConf.PCIaddr
+		// a VF bound to a userspace driver cannot be told in use or not
+		if ledgered[saved.containerID] || owned[pciAddr] || nf.DPDKMode {
+			continue
+		}
+		// a VF without netdev in the host netns is still in the pod netns
+		vf := state.vfs[pciAddr]
+		if vf == nil || len(vf.names) == 0 {
+			continue
+		}
+
+		c := vf.config
+		if c.Vlan != 0 || c.MinTxRate != 0 || c.MaxTxRate != 0 {
+			alloc := &vfAllocation{
+				PFName:    vf.pfName,
+				VF:        c.VF,
+				PCIAddr:   pciAddr,
+				VLAN:      c.Vlan,
+				MinTxRate: c.MinTxRate,
+				MaxTxRate: c.MaxTxRate,
+			}
+			actions = append(actions, reconcileAction{
+				description: fmt.Sprintf("reset vf %d of %s (%s, %s) left by container %s: vlan %d, min_tx_rate %d, max_tx_rate %d",
+					c.VF, vf.pfName, pciAddr, strings.Join(vf.names, ", "), saved.containerID, c.Vlan, c.MinTxRate, c.MaxTxRate),
+				apply: func() error {
+					return resetVF(alloc)
+				},
+			})
+		}
+
+		for _, name := range vf.names {
+			if temporaryVFName.MatchString(name) {
+				notes = append(notes, fmt.Sprintf("vf %d of %s (%s) left by container %s is still named %s, its original name was not recorded",
+					c.VF, vf.pfName, pciAddr, saved.containerID, name))
+			}
+		}
+	}
+
+	return actions, notes
+}
+
+// containerExists tells whether the container a ledger was written for is
+// still around, by its netns.
+func containerExists(netnsPath string) bool {
+	return netnsPath != "" && ns.IsNSorErr(netnsPath) == nil
+}
+
+func describeLedger(l *podLedger) string {
+	var vfs []string
+	for _, a := range l.Allocations {
+		if a.VFReleased {
+			vfs = append(vfs, fmt.Sprintf("%s: addresses", a.PodIfName))
+			continue
+		}
+		vfs = append(vfs, fmt.Sprintf("%s: vf %d of %s (%s)", a.PodIfName, a.VF, a.PFName, a.PCIAddr))
+	}
+
+	pod := "unknown pod"
+	if l.PodName != "" {
+		pod = fmt.Sprintf("pod %s/%s", l.PodNamespace, l.PodName)
+	}
+	if len(vfs) == 0 {
+		return pod
+	}
+	return fmt.Sprintf("%s [%s]", pod, strings.Join(vfs, "; "))
+}
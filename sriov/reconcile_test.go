@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestTemporaryVFName(t *testing.T) {
+	for name, temporary := range map[string]bool{
+		"dev7":       true,
+		"dev123":     true,
+		"sriov0":     true,
+		"sriov9999":  true,
+		"sriov10000": false,
+		"dev":        false,
+		"sriov":      false,
+		"eth0":       false,
+		"ens1f0v3":   false,
+		"mydev7":     false,
+		"dev7a":      false,
+	} {
+		if got := temporaryVFName.MatchString(name); got != temporary {
+			t.Errorf("%s: temporary %v, want %v", name, got, temporary)
+		}
+	}
+}
+
+func savedTestNetConf(cid, podIfName, pciAddr string, dpdk bool) *savedNetConf {
+	nf := &NetConf{DPDKMode: dpdk, PFName: "ens1f0"}
+	nf.DPDKConf.PCIaddr = pciAddr
+	nf.DPDKConf.Ifname = podIfName
+	return &savedNetConf{containerID: cid, conf: nf}
+}
+
+func TestPlanReconcile(t *testing.T) {
+	released := testLedger("c3", "eth0")
+	released.Allocations[0].VFReleased = true
+	released.Allocations[0].IPAM = &ipamHandle{Type: "host-local"}
+
+	cases := []struct {
+		name    string
+		state   *reconcileState
+		actions []string
+		notes   []string
+	}{
+		{
+			name:  "nothing recorded",
+			state: &reconcileState{},
+		},
+		{
+			name: "live and gone containers",
+			state: &reconcileState{
+				ledgers: []*podLedger{testLedger("c1", "eth0"), testLedger("c2", "eth0", "eth1"), released},
+				live:    map[string]bool{"c1": true},
+			},
+			actions: []string{
+				"release unknown pod [eth0: vf 0 of ens1f0 (0000:03:00.1); eth1: vf 1 of ens1f0 (0000:03:00.1)] of container c2",
+				"release unknown pod [eth0: addresses] of container c3",
+			},
+		},
+		{
+			name: "unrecorded VFs are left alone",
+			state: &reconcileState{
+				vfs: map[string]*hostVF{
+					"0000:03:00.2": {pfName: "ens1f0", config: vfConfig{VF: 1, Vlan: 100}, names: []string{"dev12"}},
+				},
+			},
+		},
+		{
+			name: "saved netconf without ledger",
+			state: &reconcileState{
+				saved: []*savedNetConf{
+					savedTestNetConf("c1", "eth0", "0000:03:00.2", false),
+					savedTestNetConf("c1", "eth1", "0000:03:00.3", false),
+					savedTestNetConf("c2", "eth0", "0000:03:00.4", false),
+				},
+				vfs: map[string]*hostVF{
+					"0000:03:00.2": {pfName: "ens1f0", config: vfConfig{VF: 1, Vlan: 100, MaxTxRate: 5000}, names: []string{"dev12"}},
+					"0000:03:00.3": {pfName: "ens1f0", config: vfConfig{VF: 2}, names: []string{"sriov42", "ens1f0v2"}},
+					"0000:03:00.4": {pfName: "ens1f0", config: vfConfig{VF: 3}, names: []string{"ens1f0v3"}},
+				},
+			},
+			actions: []string{
+				"reset vf 1 of ens1f0 (0000:03:00.2, dev12) left by container c1: vlan 100, min_tx_rate 0, max_tx_rate 5000",
+			},
+			notes: []string{
+				"vf 1 of ens1f0 (0000:03:00.2) left by container c1 is still named dev12, its original name was not recorded",
+				"vf 2 of ens1f0 (0000:03:00.3) left by container c1 is still named sriov42, its original name was not recorded",
+			},
+		},
+		{
+			name: "saved netconf of VFs in use or released by a ledger",
+			state: &reconcileState{
+				ledgers: []*podLedger{testLedger("c1", "eth0"), testLedger("c2", "eth0")},
+				live:    map[string]bool{"c1": true, "c2": true},
+				saved: []*savedNetConf{
+					// the ledger of the container releases it
+					savedTestNetConf("c1", "eth0", "0000:03:00.2", false),
+					// a pod with a ledger took the VF over
+					savedTestNetConf("c9", "eth0", "0000:03:00.1", false),
+					// still in the pod netns
+					savedTestNetConf("c9", "eth1", "0000:03:00.3", false),
+					// bound to the DPDK driver
+					savedTestNetConf("c9", "eth2", "0000:03:00.4", true),
+					// on a PF the daemon does not manage
+					savedTestNetConf("c9", "eth3", "0000:81:00.1", false),
+				},
+				vfs: map[string]*hostVF{
+					"0000:03:00.1": {pfName: "ens1f0", config: vfConfig{VF: 0, Vlan: 100}, names: []string{"dev3"}},
+					"0000:03:00.2": {pfName: "ens1f0", config: vfConfig{VF: 1, Vlan: 100}, names: []string{"dev4"}},
+					"0000:03:00.3": {pfName: "ens1f0", config: vfConfig{VF: 2, Vlan: 100}},
+					"0000:03:00.4": {pfName: "ens1f0", config: vfConfig{VF: 3, Vlan: 100}},
+				},
+			},
+		},
+	}
+
+	for _, c := range cases {
+		actions, notes := planReconcile(&NetConf{}, c.state)
+		var got []string
+		for _, a := range actions {
+			got = append(got, a.description)
+		}
+		if !reflect.DeepEqual(got, c.actions) {
+			t.Errorf("%s: actions %q, want %q", c.name, got, c.actions)
+		}
+		if !reflect.DeepEqual(notes, c.notes) {
+			t.Errorf("%s: notes %q, want %q", c.name, notes, c.notes)
+		}
+	}
+}
+
+func TestListSavedNetConfs(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	for _, saved := range []*savedNetConf{
+		savedTestNetConf("c1", "eth0", "0000:03:00.2", false),
+		savedTestNetConf("c-2", "eth1", "0000:03:00.3", true),
+	} {
+		if err := saveNetConf(saved.containerID, dir, saved.conf); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := testLedger("c1", "eth0").save(dir); err != nil {
+		t.Fatal(err)
+	}
+	data, err := json.Marshal(savedTestNetConf("c3", "eth0", "0000:03:00.4", false).conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range map[string][]byte{
+		"c3-eth1": data,
+		"c4-eth0": []byte("{"),
+	} {
+		if err = ioutil.WriteFile(filepath.Join(dir, name), content, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	saved, err := listSavedNetConfs(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, s := range saved {
+		got = append(got, s.containerID+" "+s.conf.DPDKConf.Ifname+" "+s.conf.DPDKConf.PCIaddr)
+	}
+	want := []string{"c-2 eth1 0000:03:00.3", "c1 eth0 0000:03:00.2"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("listed %q, want %q", got, want)
+	}
+}
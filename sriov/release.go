@@ -0,0 +1,279 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/containernetworking/cni/pkg/ns"
+	"github.com/vishvananda/netlink"
+)
+
+// hostVFWait is how long cmdDel waits for the VF netdevs of a pod
+// interface to show up in the host netns. When the runtime removed the pod
+// netns before calling DEL, the kernel only moves the VFs back once the
+// last reference to the netns is gone.
+var hostVFWait = 10 * time.Second
+
+// releaseLedger releases every VF recorded for the container. The VFs are
+// taken out of the pod netns if it still exists; otherwise they are reset
+// from the PF and picked up again in the host netns. Released VFs are
+// dropped from the ledger right away and failures are recorded, so that a
+// retried DEL only redoes what is left.
+func releaseLedger(conf *NetConf, ledger *podLedger, netnsPath string) error {
+	var netns ns.NetNS
+	if netnsPath != "" {
+		var err error
+		netns, err = ns.GetNS(netnsPath)
+		switch err.(type) {
+		case nil:
+			defer netns.Close()
+		case ns.NSPathNotExistErr, ns.NSPathNotNSErr:
+			log.Printf("RIT-CNI: netns %s is gone, releasing the VFs of %s from the host\n", netnsPath, ledger.ContainerID)
+			netns = nil
+		default:
+			return fmt.Errorf("failed to open netns %q: %v", netnsPath, err)
+		}
+	}
+
+	var failed []string
+	for _, alloc := range append([]*vfAllocation{}, ledger.Allocations...) {
+		if err := releaseAllocation(conf, alloc, netns); err != nil {
+			log.Printf("RIT-CNI: failed to release vf %d of %s for %s: %v\n", alloc.VF, alloc.PFName, alloc.PodIfName, err)
+			alloc.LastError = err.Error()
+			failed = append(failed, fmt.Sprintf("%s: %v", alloc.PodIfName, err))
+		} else {
+			if err = deleteNetConf(ledger.ContainerID, alloc.PodIfName, conf.CNIDir); err != nil {
+				log.Printf("RIT-CNI: %v\n", err)
+			}
+			ledger.forget(alloc.PodIfName)
+		}
+		if err := ledger.save(conf.CNIDir); err != nil {
+			return err
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("failed to release the VFs of %s: %s", ledger.ContainerID, strings.Join(failed, "; "))
+	}
+
+	return removeLedger(conf.CNIDir, ledger.ContainerID)
+}
+
+// releaseAllocation releases the addresses of a pod interface and gives
+// its VF back to the host. netns is nil if the pod netns is gone. The VF is
+// released even if the IPAM plugin fails, so that only the addresses are
+// left for the next try. Every step can be repeated, so a release that
+// failed half way is simply run again.
+func releaseAllocation(conf *NetConf, alloc *vfAllocation, netns ns.NetNS) error {
+	var ipamErr error
+	if alloc.IPAM != nil && !alloc.IPAM.Released {
+		if err := execIPAMDel(alloc.IPAM); err != nil {
+			ipamErr = fmt.Errorf("failed to release the addresses of %s with %s: %v", alloc.PodIfName, alloc.IPAM.Type, err)
+		} else {
+			alloc.IPAM.Released = true
+		}
+	}
+
+	if !alloc.VFReleased {
+		if err := releaseVF(conf, alloc, netns); err != nil {
+			if ipamErr != nil {
+				return fmt.Errorf("%v; %v", ipamErr, err)
+			}
+			return err
+		}
+		alloc.VFReleased = true
+	}
+	return ipamErr
+}
+
+// releaseVF gives the VF of a pod interface back to the host as it was
+// before cmdAdd: bound to its kernel driver, without VLAN, rate limits and
+// pod MAC, and under its original name.
+func releaseVF(conf *NetConf, alloc *vfAllocation, netns ns.NetNS) error {
+	// the VFs of the PF were removed, e.g. by disabling SR-IOV, so there
+	//	is nothing left to reset
+	if _, err := os.Stat(filepath.Join(sysBusPciDir, "devices", alloc.PCIAddr)); os.IsNotExist(err) {
+		log.Printf("RIT-CNI: vf %d of %s (%s) no longer exists\n", alloc.VF, alloc.PFName, alloc.PCIAddr)
+		return nil
+	}
+
+	if alloc.Mode == vfModeDPDK {
+		dpdk := dpdkConf{
+			PCIaddr:  alloc.PCIAddr,
+			KDriver:  alloc.KernelDriver,
+			DPDKtool: conf.DPDKConf.DPDKtool,
+		}
+		if err := enabledpdkmode(&dpdk, "", false); err != nil {
+			return fmt.Errorf("failed to bind %s to %s: %v", alloc.PCIAddr, alloc.KernelDriver, err)
+		}
+	} else if netns != nil {
+		if err := moveVFToHost(alloc, netns); err != nil {
+			return err
+		}
+	}
+
+	if err := resetVF(alloc); err != nil {
+		return err
+	}
+
+	names, err := waitForHostVF(alloc)
+	if err != nil {
+		return err
+	}
+	return restoreVFNames(alloc, names)
+}
+
+// moveVFToHost moves the netdevs of the pod interface from the pod netns
+// to the host netns, under a name that cannot clash with a host netdev.
+// A netdev is looked up under its pod name, or under its host name if
+// cmdAdd failed before renaming it. Netdevs that are no longer in the pod
+// netns are skipped.
+func moveVFToHost(alloc *vfAllocation, netns ns.NetNS) error {
+	hostns, err := ns.GetCurrentNS()
+	if err != nil {
+		return fmt.Errorf("failed to get the host netns: %v", err)
+	}
+	defer hostns.Close()
+
+	names := [][]string{{alloc.PodIfName, alloc.OrigName}}
+	if alloc.SharedOrigName != "" {
+		names = append(names, []string{alloc.PodIfName + "d1", alloc.SharedOrigName})
+	}
+
+	return netns.Do(func(_ ns.NetNS) error {
+		for _, candidates := range names {
+			ifName := candidates[0]
+			vfDev, err := netlink.LinkByName(ifName)
+			if err != nil && candidates[1] != "" {
+				ifName = candidates[1]
+				vfDev, err = netlink.LinkByName(ifName)
+			}
+			if err != nil {
+				log.Printf("RIT-CNI: %s is not in netns %s, looking for it in the host\n", candidates[0], netns.Path())
+				continue
+			}
+
+			devName := fmt.Sprintf("dev%d", vfDev.Attrs().Index)
+			if err = netlink.LinkSetDown(vfDev); err != nil {
+				return fmt.Errorf("failed to down vf device %q: %v", ifName, err)
+			}
+			if err = netlink.LinkSetName(vfDev, devName); err != nil {
+				return fmt.Errorf("failed to rename vf device %q to %q: %v", ifName, devName, err)
+			}
+			if err = netlink.LinkSetNsFd(vfDev, int(hostns.Fd())); err != nil {
+				return fmt.Errorf("failed to move vf device %q to the host netns: %v", ifName, err)
+			}
+		}
+		return nil
+	})
+}
+
+// resetVF clears what cmdAdd programmed for the VF on its PF. It only needs
+// the PF, so it works wherever the VF netdev is.
+func resetVF(alloc *vfAllocation) error {
+	pfLink, err := netlink.LinkByName(alloc.PFName)
+	if err != nil {
+		return fmt.Errorf("failed to lookup master %q: %v", alloc.PFName, err)
+	}
+
+	if alloc.VLAN != 0 {
+		if err = netlink.LinkSetVfVlan(pfLink, alloc.VF, 0); err != nil {
+			return fmt.Errorf("failed to reset vlan tag for vf %d: %v", alloc.VF, err)
+		}
+		if alloc.SharedOrigName != "" {
+			if err = setSharedVfVlan(alloc.PFName, alloc.VF, 0); err != nil {
+				return fmt.Errorf("failed to reset vlan tag for shared vf %d: %v", alloc.VF, err)
+			}
+		}
+	}
+
+	if alloc.MinTxRate != 0 || alloc.MaxTxRate != 0 {
+		if err = setVfBandwidthLimits(alloc.PFName, alloc.VF, 0, 0); err != nil {
+			return fmt.Errorf("failed resetting bandwidth limits of vf %d: %v", alloc.VF, err)
+		}
+	}
+
+	return nil
+}
+
+// hostVFNames returns the netdevs of the VF in the host netns, ordered like
+// setupVF orders them.
+func hostVFNames(pciAddr string) ([]string, error) {
+	infos, err := ioutil.ReadDir(filepath.Join(sysBusPciDir, "devices", pciAddr, "net"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read the netdevs of %s: %v", pciAddr, err)
+	}
+	if len(infos) > 1 {
+		sort.Sort(LinksByIndex(infos))
+	}
+
+	names := make([]string, len(infos))
+	for i := range infos {
+		names[i] = infos[i].Name()
+	}
+	return names, nil
+}
+
+// waitForHostVF waits up to hostVFWait for every netdev of the VF to be
+// back in the host netns and returns their names.
+func waitForHostVF(alloc *vfAllocation) ([]string, error) {
+	want := 1
+	if alloc.SharedOrigName != "" {
+		want = maxSharedVf
+	}
+
+	deadline := time.Now().Add(hostVFWait)
+	for {
+		names, err := hostVFNames(alloc.PCIAddr)
+		if err != nil {
+			return nil, err
+		}
+		if len(names) >= want {
+			return names, nil
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("vf %d of %s (%s) did not show up in the host netns within %v",
+				alloc.VF, alloc.PFName, alloc.PCIAddr, hostVFWait)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// restoreVFNames gives the netdevs of the VF back the MAC and names they
+// had before cmdAdd. A name that another netdev took in the meantime is
+// left alone.
+func restoreVFNames(alloc *vfAllocation, names []string) error {
+	if alloc.MAC != "" && alloc.OrigMAC != "" && alloc.MAC != alloc.OrigMAC {
+		pfLink, err := netlink.LinkByName(alloc.PFName)
+		if err != nil {
+			return fmt.Errorf("failed to lookup master %q: %v", alloc.PFName, err)
+		}
+		if err = setVfMac(pfLink, alloc.VF, names[0], alloc.OrigMAC); err != nil {
+			return err
+		}
+	}
+
+	origNames := []string{alloc.OrigName, alloc.SharedOrigName}
+	for i, name := range names {
+		if i >= len(origNames) || origNames[i] == "" || name == origNames[i] {
+			continue
+		}
+		if _, err := netlink.LinkByName(origNames[i]); err == nil {
+			log.Printf("RIT-CNI: %s is taken, leaving vf %d of %s as %s\n", origNames[i], alloc.VF, alloc.PFName, name)
+			continue
+		}
+		if err := renameLink(name, origNames[i]); err != nil {
+			return fmt.Errorf("failed to rename vf device %q back to %q: %v", name, origNames[i], err)
+		}
+	}
+
+	return nil
+}
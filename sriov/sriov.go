@@ -22,19 +22,20 @@ import (
 	"github.com/rit-k8s-rdma/rit-k8s-rdma-common/rdma_hardware_info"
 	types040 "github.com/rit-k8s-rdma/rit-k8s-rdma-sriov-cni/sriov/cni/types"
 	"github.com/rit-k8s-rdma/rit-k8s-rdma-sriov-cni/sriov/cni/types/current"
-	"github.com/rit-k8s-rdma/rit-k8s-rdma-sriov-cni/sriov/cni/types/types020"
+	"github.com/rit-k8s-rdma/rit-k8s-rdma-sriov-cni/sriov/placement"
 	sriovnet "github.com/rit-k8s-rdma/rit-k8s-rdma-sriovnet"
 
 	"github.com/containernetworking/cni/pkg/ipam"
 	"github.com/containernetworking/cni/pkg/ns"
 	"github.com/containernetworking/cni/pkg/skel"
 	"github.com/containernetworking/cni/pkg/types"
-	"github.com/fabiokung/shm"
 	"github.com/vishvananda/netlink"
 	vishNetns "github.com/vishvananda/netns"
 
-	//	errors2 "k8s.io/apimachinery/pkg/api/errors"
+	corev1 "k8s.io/api/core/v1"
+	errors2 "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	k8stypes "k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/tools/clientcmd"
 )
@@ -49,10 +50,13 @@ type dpdkConf struct {
 	DPDKDriver string `json:"dpdk_driver"`
 	DPDKtool   string `json:"dpdk_tool"`
 	VFID       int    `json:"vfid"`
+	// bind to vfio-pci and hand the IOMMU group to the pod
+	VFIO       bool   `json:"vfio"`
+	VFIODevice string `json:"vfio_device,omitempty"`
 }
 
 type NetConf struct {
-	types.NetConf
+	types040.NetConf
 	DPDKMode bool
 	Sharedvf bool
 	DPDKConf dpdkConf `json:"dpdk,omitempty"`
@@ -60,6 +64,25 @@ type NetConf struct {
 	IF0NAME  string   `json:"if0name"`
 	L2Mode   bool     `json:"l2enable"`
 	Vlan     int      `json:"vlan"`
+	// strategy used to choose the PF of every pod interface
+	Placement string `json:"placement,omitempty"`
+	// how the bandwidth of the PFs is shared, overridden per PF name
+	Policy     placement.Policy            `json:"policy,omitempty"`
+	PFPolicies map[string]placement.Policy `json:"pfPolicies,omitempty"`
+
+	RuntimeConfig RuntimeConfig `json:"runtimeConfig,omitempty"`
+
+	// how long to wait for the node lock, as a Go duration
+	LockTimeout string `json:"lockTimeout,omitempty"`
+	lockTimeout time.Duration
+
+	// filled in per pod interface by cmdAdd and setupVF, and saved in
+	// cniDir so cmdCheck/cmdDel know which PF the VF belongs to and how
+	// it was programmed
+	MAC       string `json:"mac,omitempty"`
+	PFName    string `json:"pfName,omitempty"`
+	MinTxRate uint   `json:"minTxRate,omitempty"`
+	MaxTxRate uint   `json:"maxTxRate,omitempty"`
 }
 
 type pfInfo struct {
@@ -104,16 +127,6 @@ func init() {
 	runtime.LockOSThread()
 }
 
-func setVfBandwidthLimits(pfName string, vfNumber string, minTxRate string, maxTxRate string) error {
-	cmnd := exec.Command("/sbin/ip", "link", "set", "dev", pfName, "vf", vfNumber, "max_tx_rate", maxTxRate, "min_tx_rate", minTxRate)
-	err := cmnd.Start()
-	if err != nil {
-		return fmt.Errorf("Iproute2 command failed with message: %s", err)
-	}
-
-	return nil
-}
-
 func checkIf0name(ifname string) bool {
 	op := []string{"eth0", "eth1", "lo", ""}
 	for _, if0name := range op {
@@ -138,12 +151,51 @@ func loadConf(bytes []byte) (*NetConf, error) {
 		}
 	}
 
+	if err := validateVersion(n.CNIVersion); err != nil {
+		return nil, err
+	}
+
+	if _, err := parsePrevResult(n); err != nil {
+		return nil, err
+	}
+
 	if n.CNIDir == "" {
 		n.CNIDir = defaultCNIDir
 	}
 
+	if n.LockTimeout != "" {
+		timeout, err := time.ParseDuration(n.LockTimeout)
+		if err != nil || timeout <= 0 {
+			return nil, fmt.Errorf(`invalid "lockTimeout" %q, expected a positive duration like "30s"`, n.LockTimeout)
+		}
+		n.lockTimeout = timeout
+	}
+
+	if _, err := placement.New(n.Placement); err != nil {
+		return nil, err
+	}
+	if err := n.Policy.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid policy: %v", err)
+	}
+	for pfName, policy := range n.PFPolicies {
+		if err := policy.Validate(); err != nil {
+			return nil, fmt.Errorf("invalid policy of %s: %v", pfName, err)
+		}
+	}
+
 	if (dpdkConf{}) != n.DPDKConf {
 		n.DPDKMode = true
+		if n.DPDKConf.VFIO {
+			if n.DPDKConf.DPDKDriver == "" {
+				n.DPDKConf.DPDKDriver = vfioDriver
+			}
+			if n.DPDKConf.DPDKDriver != vfioDriver {
+				return nil, fmt.Errorf(`"vfio" mode binds to %q, not %q`, vfioDriver, n.DPDKConf.DPDKDriver)
+			}
+		}
+		if n.DPDKConf.KDriver == "" || n.DPDKConf.DPDKDriver == "" {
+			return nil, fmt.Errorf(`"dpdk" needs both "kernel_driver" and "dpdk_driver"`)
+		}
 	}
 
 	return n, nil
@@ -164,9 +216,8 @@ func saveScratchNetConf(containerID, dataDir string, netconf []byte) error {
 	return err
 }
 
-func consumeScratchNetConf(containerID, dataDir string) ([]byte, error) {
+func readScratchNetConf(containerID, dataDir string) ([]byte, error) {
 	path := filepath.Join(dataDir, containerID)
-	defer os.Remove(path)
 
 	data, err := ioutil.ReadFile(path)
 	if err != nil {
@@ -193,11 +244,13 @@ func saveNetConf(cid, dataDir string, conf *NetConf) error {
 	return nil
 }
 
+// getNetConf reads the netconf saved for the pod interface. It is left in
+// place until the VF is released, so that a retried DEL still finds it.
 func (nc *NetConf) getNetConf(cid, podIfName, dataDir string, conf *NetConf) error {
 	s := []string{cid, podIfName}
 	cRef := strings.Join(s, "-")
 
-	confBytes, err := consumeScratchNetConf(cRef, dataDir)
+	confBytes, err := readScratchNetConf(cRef, dataDir)
 	if err != nil {
 		return err
 	}
@@ -209,6 +262,43 @@ func (nc *NetConf) getNetConf(cid, podIfName, dataDir string, conf *NetConf) err
 	return nil
 }
 
+func deleteNetConf(cid, podIfName, dataDir string) error {
+	s := []string{cid, podIfName}
+	path := filepath.Join(dataDir, strings.Join(s, "-"))
+
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove container data in the path(%q): %v", path, err)
+	}
+
+	return nil
+}
+
+// getSavedNetConfs returns the netconf saved by setupVF for every pod
+// interface of the container, without consuming it.
+func getSavedNetConfs(cid, dataDir string) ([]*NetConf, error) {
+	paths, err := filepath.Glob(filepath.Join(dataDir, cid+"-*"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list container data in %q: %v", dataDir, err)
+	}
+	sort.Strings(paths)
+
+	var confs []*NetConf
+	for _, path := range paths {
+		confBytes, err := readScratchNetConf(filepath.Base(path), dataDir)
+		if err != nil {
+			return nil, err
+		}
+
+		nc := &NetConf{}
+		if err = json.Unmarshal(confBytes, nc); err != nil {
+			return nil, fmt.Errorf("failed to parse netconf %q: %v", path, err)
+		}
+		confs = append(confs, nc)
+	}
+
+	return confs, nil
+}
+
 // Devices is ordered by its number of VFs, device that has the
 // most number of vfs will be first in the list.
 func getOrderedPF(devices []string) ([]string, error) {
@@ -232,8 +322,10 @@ func getOrderedPF(devices []string) ([]string, error) {
 	return result, nil
 }
 
+// enabledpdkmode binds the VF to the DPDK driver, or back to the kernel
+// driver. dpdk_tool is only used when configured, the binding is done
+// through sysfs otherwise.
 func enabledpdkmode(conf *dpdkConf, ifname string, dpdkmode bool) error {
-	stdout := &bytes.Buffer{}
 	var driver string
 	var device string
 
@@ -245,14 +337,21 @@ func enabledpdkmode(conf *dpdkConf, ifname string, dpdkmode bool) error {
 		device = conf.PCIaddr
 	}
 
+	if conf.DPDKtool == "" {
+		// the kernel driver is bound back without override, the DPDK
+		//	driver keeps the device pinned to it
+		return bindPciDriver(conf.PCIaddr, driver, dpdkmode)
+	}
+
+	stdout := &bytes.Buffer{}
 	cmd := exec.Command(conf.DPDKtool, "-b", driver, device)
 	cmd.Stdout = stdout
+	cmd.Stderr = stdout
 	err := cmd.Run()
 	if err != nil {
-		return fmt.Errorf("DPDK binding failed with err msg %q:", stdout.String())
+		return fmt.Errorf("DPDK binding failed with err msg %q: %v", stdout.String(), err)
 	}
 
-	stdout.Reset()
 	return nil
 }
 
@@ -369,6 +468,29 @@ func setSharedVfVlan(ifName string, vfIdx int, vlan int) error {
 	return nil
 }
 
+// setVfMac sets the administrative MAC of the VF on the PF and the MAC of
+// its netdev, so that the address survives a reset of the VF driver.
+func setVfMac(pfLink netlink.Link, vfIdx int, vfName string, mac string) error {
+	hwaddr, err := net.ParseMAC(mac)
+	if err != nil {
+		return fmt.Errorf("invalid MAC address %q: %v", mac, err)
+	}
+
+	if err = netlink.LinkSetVfHardwareAddr(pfLink, vfIdx, hwaddr); err != nil {
+		return fmt.Errorf("failed to set vf %d MAC to %s: %v", vfIdx, mac, err)
+	}
+
+	vfDev, err := netlink.LinkByName(vfName)
+	if err != nil {
+		return fmt.Errorf("failed to lookup vf device %q: %v", vfName, err)
+	}
+	if err = netlink.LinkSetHardwareAddr(vfDev, hwaddr); err != nil {
+		return fmt.Errorf("failed to set MAC of vf device %q to %s: %v", vfName, mac, err)
+	}
+
+	return nil
+}
+
 func configSriov(master string) error {
 	err := sriovnet.EnableSriov(master)
 	if err != nil {
@@ -387,7 +509,11 @@ func configSriov(master string) error {
 	return nil
 }
 
-func setupVF(conf *NetConf, ifName string, podifName string, cid string, netns ns.NetNS, pod_interfaces_required knapsack_pod_placement.RdmaInterfaceRequest) (*int, error) {
+// setupVF moves a free VF of the PF ifName into the pod as podifName. If
+// requestedVf is not negative, only that VF is considered and setupVF
+// fails if it is no longer free. The VF is recorded in the ledger before
+// it is configured.
+func setupVF(conf *NetConf, ifName string, podifName string, cid string, netns ns.NetNS, pod_interfaces_required knapsack_pod_placement.RdmaInterfaceRequest, requestedVf int, ledger *podLedger) (*int, error) {
 	log.Println("RIT-CNI: ENTERING setupVF")
 
 	var vfIdx int
@@ -406,7 +532,18 @@ func setupVF(conf *NetConf, ifName string, podifName string, cid string, netns n
 	}
 
 	for vf := 0; vf <= (vfTotal - 1); vf++ {
+		if requestedVf >= 0 && vf != requestedVf {
+			continue
+		}
 		vfDir := fmt.Sprintf("/sys/class/net/%s/device/virtfn%d/net", ifName, vf)
+		if requestedVf >= 0 {
+			// a VF without netdev in the host netns is in another pod or
+			//	bound to a userspace driver
+			if infos, err = ioutil.ReadDir(vfDir); err != nil || len(infos) == 0 {
+				return nil, newError(errCodeVfUnavailable, "VF no longer free",
+					"vf %d of %s has no netdev in the host netns", vf, ifName)
+			}
+		}
 		if _, err := os.Lstat(vfDir); err != nil {
 			if vf == (vfTotal - 1) {
 				return nil, fmt.Errorf("failed to open the virtfn%d dir of the device %q: %v", vf, ifName, err)
@@ -438,15 +575,6 @@ func setupVF(conf *NetConf, ifName string, podifName string, cid string, netns n
 				return nil, fmt.Errorf("err in getting pci address - %q", err)
 			}
 
-			err := setVfBandwidthLimits(
-				ifName,
-				fmt.Sprintf("%d", vfIdx),
-				fmt.Sprintf("%d", pod_interfaces_required.MinTxRate),
-				fmt.Sprintf("%d", pod_interfaces_required.MaxTxRate))
-			if err != nil {
-				return &vfIdx, fmt.Errorf("Failed setting the min and max tx rates on PF[%s] VF[%d]: %s", ifName, vf, err)
-			}
-
 			break
 		} else {
 			return nil, fmt.Errorf("mutiple network devices in directory %s", vfDir)
@@ -462,6 +590,44 @@ func setupVF(conf *NetConf, ifName string, podifName string, cid string, netns n
 		return &vfIdx, fmt.Errorf("l2enable mode must be true to use shared net interface %q", ifName)
 	}
 
+	// Sort links name if there are 2 or more PF links found for a VF;
+	if len(infos) > 1 {
+		// sort Links FileInfo by their Link indices
+		sort.Sort(LinksByIndex(infos))
+	}
+
+	// record the VF as it is before anything is changed
+	alloc := &vfAllocation{
+		PodIfName: podifName,
+		PFName:    ifName,
+		VF:        vfIdx,
+		PCIAddr:   pciAddr,
+		OrigName:  infos[0].Name(),
+		MAC:       conf.MAC,
+		VLAN:      conf.Vlan,
+		MinTxRate: pod_interfaces_required.MinTxRate,
+		MaxTxRate: pod_interfaces_required.MaxTxRate,
+		Mode:      conf.vfMode(),
+	}
+	if len(infos) == maxSharedVf {
+		alloc.SharedOrigName = infos[1].Name()
+	}
+	if conf.DPDKMode {
+		alloc.KernelDriver = conf.DPDKConf.KDriver
+	}
+	if vfDev, err := netlink.LinkByName(infos[0].Name()); err == nil {
+		alloc.OrigMAC = vfDev.Attrs().HardwareAddr.String()
+	}
+	ledger.record(alloc)
+	if err = ledger.save(conf.CNIDir); err != nil {
+		return nil, err
+	}
+
+	err = setVfBandwidthLimits(ifName, vfIdx, pod_interfaces_required.MinTxRate, pod_interfaces_required.MaxTxRate)
+	if err != nil {
+		return &vfIdx, fmt.Errorf("Failed setting the min and max tx rates on PF[%s] VF[%d]: %s", ifName, vfIdx, err)
+	}
+
 	if conf.Vlan != 0 {
 		if err = netlink.LinkSetVfVlan(m, vfIdx, conf.Vlan); err != nil {
 			return &vfIdx, fmt.Errorf("failed to set vf %d vlan: %v", vfIdx, err)
@@ -474,20 +640,45 @@ func setupVF(conf *NetConf, ifName string, podifName string, cid string, netns n
 		}
 	}
 
+	if conf.MAC != "" {
+		if err = setVfMac(m, vfIdx, infos[0].Name(), conf.MAC); err != nil {
+			return &vfIdx, err
+		}
+	}
+
 	conf.DPDKConf.PCIaddr = pciAddr
 	conf.DPDKConf.Ifname = podifName
 	conf.DPDKConf.VFID = vfIdx
+	conf.PFName = ifName
+	conf.MinTxRate = pod_interfaces_required.MinTxRate
+	conf.MaxTxRate = pod_interfaces_required.MaxTxRate
 	if conf.DPDKMode != false {
+		// the netdev, and with it the MAC, is gone once the VF is bound
+		if conf.MAC == "" {
+			vfDev, err := netlink.LinkByName(infos[0].Name())
+			if err != nil {
+				return &vfIdx, fmt.Errorf("failed to lookup vf device %q: %v", infos[0].Name(), err)
+			}
+			conf.MAC = vfDev.Attrs().HardwareAddr.String()
+		}
+		if conf.DPDKConf.VFIO {
+			conf.DPDKConf.VFIODevice, err = getVfioDevice(pciAddr)
+			if err != nil {
+				return &vfIdx, err
+			}
+		}
 		if err = saveNetConf(cid, conf.CNIDir, conf); err != nil {
 			return &vfIdx, err
 		}
-		return &vfIdx, enabledpdkmode(&conf.DPDKConf, infos[0].Name(), true)
-	}
-
-	// Sort links name if there are 2 or more PF links found for a VF;
-	if len(infos) > 1 {
-		// sort Links FileInfo by their Link indices
-		sort.Sort(LinksByIndex(infos))
+		if err = enabledpdkmode(&conf.DPDKConf, infos[0].Name(), true); err != nil {
+			return &vfIdx, err
+		}
+		if conf.DPDKConf.VFIO {
+			if _, err = os.Stat(conf.DPDKConf.VFIODevice); err != nil {
+				return &vfIdx, fmt.Errorf("vfio device of vf %d not created: %v", vfIdx, err)
+			}
+		}
+		return &vfIdx, nil
 	}
 
 	var vfName string
@@ -547,133 +738,58 @@ func setupVF(conf *NetConf, ifName string, podifName string, cid string, netns n
 	})
 }
 
-func releaseVF(conf *NetConf, podifName string, cid string, netns ns.NetNS, pfName string, vfNumber *int) error {
-	log.Println("RIT-CNI: RELEASEVF")
-
-	nf := &NetConf{}
-	// get the net conf in cniDir
-	if err := nf.getNetConf(cid, podifName, conf.CNIDir, conf); err != nil {
-		return err
+// getPodInterface describes the VF that setupVF moved into the pod as
+// ifName, for the ADD result.
+func getPodInterface(conf *NetConf, ifName string, netns ns.NetNS) (*current.Interface, error) {
+	podInterface := &current.Interface{
+		Name:    ifName,
+		Sandbox: netns.Path(),
+		PciID:   conf.DPDKConf.PCIaddr,
 	}
 
-	// check for the DPDK mode and release the allocated DPDK resources
-	if nf.DPDKMode != false {
-		// bind the sriov vf to the kernel driver
-		if err := enabledpdkmode(&nf.DPDKConf, nf.DPDKConf.Ifname, false); err != nil {
-			return fmt.Errorf("DPDK: failed to bind %s to kernel space: %s", nf.DPDKConf.Ifname, err)
-		}
-
-		// reset vlan for DPDK code here
-		pfLink, err := netlink.LinkByName(pfName)
+	err := netns.Do(func(_ ns.NetNS) error {
+		link, err := netlink.LinkByName(ifName)
 		if err != nil {
-			return fmt.Errorf("DPDK: master device %s not found: %v", pfName, err)
-		}
-
-		if err = netlink.LinkSetVfVlan(pfLink, nf.DPDKConf.VFID, 0); err != nil {
-			return fmt.Errorf("DPDK: failed to reset vlan tag for vf %d: %v", nf.DPDKConf.VFID, err)
+			return fmt.Errorf("failed to lookup pod interface %q: %v", ifName, err)
 		}
-
+		podInterface.Mac = link.Attrs().HardwareAddr.String()
 		return nil
-	}
-
-	initns, err := ns.GetCurrentNS()
+	})
 	if err != nil {
-		return fmt.Errorf("failed to get init netns: %v", err)
-	}
-
-	if err = netns.Set(); err != nil {
-		return fmt.Errorf("failed to enter netns %q: %v", netns, err)
+		return nil, err
 	}
 
-	if conf.L2Mode != false {
-		//check for the shared vf net interface
-		ifName := podifName + "d1"
-		_, err := netlink.LinkByName(ifName)
-		if err == nil {
-			conf.Sharedvf = true
-		}
+	return podInterface, nil
+}
 
+// releaseDPDKVF gives a VF that setupVF bound to the DPDK driver back to
+// the kernel driver and resets its VLAN and rates on the PF.
+func releaseDPDKVF(nf *NetConf) error {
+	// bind the sriov vf to the kernel driver
+	if err := enabledpdkmode(&nf.DPDKConf, nf.DPDKConf.Ifname, false); err != nil {
+		return fmt.Errorf("DPDK: failed to bind %s to kernel space: %s", nf.DPDKConf.Ifname, err)
 	}
 
+	// reset vlan for DPDK code here
+	pfLink, err := netlink.LinkByName(nf.PFName)
 	if err != nil {
-		fmt.Errorf("Enable to get shared PF device: %v", err)
+		return fmt.Errorf("DPDK: master device %s not found: %v", nf.PFName, err)
 	}
 
-	for i := 1; i <= maxSharedVf; i++ {
-		ifName := podifName
-		pfName := pfName
-		if i == maxSharedVf {
-			ifName = podifName + fmt.Sprintf("d%d", i-1)
-			pfName, err = getSharedPF(pfName)
-			if err != nil {
-				return fmt.Errorf("Failed to look up shared PF device: %v:", err)
-			}
-		}
-
-		// get VF device
-		vfDev, err := netlink.LinkByName(ifName)
-		if err != nil {
-			return fmt.Errorf("failed to lookup vf device %q: %v", ifName, err)
-		}
-
-		// device name in init netns
-		index := vfDev.Attrs().Index
-		devName := fmt.Sprintf("dev%d", index)
-
-		// shutdown VF device
-		if err = netlink.LinkSetDown(vfDev); err != nil {
-			return fmt.Errorf("failed to down vf device %q: %v", ifName, err)
-		}
-
-		log.Printf("RIT-CNI: rename link: %s to %s\n", ifName, devName)
-		// rename VF device
-		err = renameLink(ifName, devName)
-		if err != nil {
-			return fmt.Errorf("failed to rename vf device %q to %q: %v", ifName, devName, err)
-		}
-
-		// move VF device to init netns
-		if err = netlink.LinkSetNsFd(vfDev, int(initns.Fd())); err != nil {
-			return fmt.Errorf("failed to move vf device %q to init netns: %v", ifName, err)
-		}
-
-		// reset vlan
-		if conf.Vlan != 0 {
-			err = initns.Do(func(_ ns.NetNS) error {
-				return resetVfVlan(pfName, devName)
-			})
-			if err != nil {
-				return fmt.Errorf("failed to reset vlan: %v", err)
-			}
-		}
-
-		if vfNumber != nil {
-			err = initns.Do(func(_ ns.NetNS) error {
-				log.Println("RIT-CNI: doing initns stuff: ", *vfNumber)
-				if err = setVfBandwidthLimits(pfName, fmt.Sprintf("%d", *vfNumber), "0", "0"); err != nil {
-					return fmt.Errorf("Failed resetting bandwidth limits: %s", err)
-				}
-				// if err = netlink.LinkSetMinMaxVfTxRate(vfDev, int(foundVf.VFNumber), uint32(0), uint32(0)); err != nil {
-				// 	log.Printf("Error setting mac address back to 0: %s\n", podInterface.HardwareAddr.String())
-				// 	return fmt.Errorf("Error setting mac address back to 0: %s\n", podInterface.HardwareAddr.String())
-				// }
-				return nil
-			})
-			if err != nil {
-				log.Println("RIT-CNI: ERROR setting the stuff")
-				return fmt.Errorf("failed to reset min/max speed: %v", err)
-			}
-		}
+	if err = netlink.LinkSetVfVlan(pfLink, nf.DPDKConf.VFID, 0); err != nil {
+		return fmt.Errorf("DPDK: failed to reset vlan tag for vf %d: %v", nf.DPDKConf.VFID, err)
+	}
 
-		//break the loop, if the namespace has no shared vf net interface
-		if conf.Sharedvf != true {
-			break
-		}
+	if err = setVfBandwidthLimits(nf.PFName, nf.DPDKConf.VFID, 0, 0); err != nil {
+		return fmt.Errorf("DPDK: failed resetting bandwidth limits of vf %d: %v", nf.DPDKConf.VFID, err)
 	}
 
 	return nil
 }
 
+// releaseVFCustom moves the VF of a pod set up before there was a ledger
+// back to the host netns and resets it. The VF is found by the MAC of the
+// pod interface.
 func releaseVFCustom(conf *NetConf, podInterface net.Interface, cid string, podNetNs string, pfs []rdma_hardware_info.PF) error {
 	log.Println("RIT-CNI: RELEASEVF")
 	// secure the thread for namespace operations
@@ -689,41 +805,28 @@ func releaseVFCustom(conf *NetConf, podInterface net.Interface, cid string, podN
 	log.Println("RIT-CNI: starting up th netConf")
 	nf := &NetConf{}
 	// get the net conf in cniDir
+	// an earlier DEL may have released the VF and removed it already
 	if err := nf.getNetConf(cid, podInterface.Name, conf.CNIDir, conf); err != nil {
-		return err
+		log.Printf("RIT-CNI: %v\n", err)
 	}
-	var foundVf *rdma_hardware_info.VF
+	var foundVfNumber int
 	var foundPfName string
 	for _, pf := range pfs {
-		foundVf = pf.FindAssociatedMac(podInterface.HardwareAddr.String())
-		if foundVf != nil {
-			foundPfName = pf.Name
+		if foundVf := pf.FindAssociatedMac(podInterface.HardwareAddr.String()); foundVf != nil {
+			foundVfNumber, foundPfName = int(foundVf.VFNumber), pf.Name
 			break
 		}
 	}
-	if foundVf == nil {
-		log.Printf("Error mac address never found: %s\n", podInterface.HardwareAddr.String())
-		log.Println("Error never found pfName of device to release")
+	if foundPfName == "" {
+		return fmt.Errorf("no VF of pod interface %q with MAC %s found", podInterface.Name, podInterface.HardwareAddr)
 	}
 
 	// check for the DPDK mode and release the allocated DPDK resources
 	if nf.DPDKMode != false {
-		// bind the sriov vf to the kernel driver
-		if err := enabledpdkmode(&nf.DPDKConf, nf.DPDKConf.Ifname, false); err != nil {
-			return fmt.Errorf("DPDK: failed to bind %s to kernel space: %s", nf.DPDKConf.Ifname, err)
-		}
-
-		// reset vlan for DPDK code here
-		pfLink, err := netlink.LinkByName(foundPfName)
-		if err != nil {
-			return fmt.Errorf("DPDK: master device %s not found: %v", foundPfName, err)
-		}
-
-		if err = netlink.LinkSetVfVlan(pfLink, nf.DPDKConf.VFID, 0); err != nil {
-			return fmt.Errorf("DPDK: failed to reset vlan tag for vf %d: %v", nf.DPDKConf.VFID, err)
+		if err = releaseDPDKVF(nf); err != nil {
+			return err
 		}
-
-		return nil
+		return deleteNetConf(cid, podInterface.Name, conf.CNIDir)
 	}
 
 	log.Println("RIT-CNI: current ns")
@@ -757,10 +860,6 @@ func releaseVFCustom(conf *NetConf, podInterface net.Interface, cid string, podN
 
 	}
 
-	if err != nil {
-		fmt.Errorf("Enable to get shared PF device: %v", err)
-	}
-
 	for i := 1; i <= maxSharedVf; i++ {
 
 		log.Println("RIT-CNI: yasdfasdf ", podInterface.Name)
@@ -813,14 +912,10 @@ func releaseVFCustom(conf *NetConf, podInterface net.Interface, cid string, podN
 		}
 
 		err = initns.Do(func(_ ns.NetNS) error {
-			log.Println("RIT-CNI: doing initns stuff ", foundVf.VFNumber, vfDev, foundVf)
-			if err = setVfBandwidthLimits(foundPfName, fmt.Sprintf("%d", foundVf.VFNumber), "0", "0"); err != nil {
+			log.Println("RIT-CNI: doing initns stuff ", foundVfNumber, vfDev)
+			if err = setVfBandwidthLimits(foundPfName, foundVfNumber, 0, 0); err != nil {
 				return fmt.Errorf("Failed resetting bandwidth limits: %s", err)
 			}
-			// if err = netlink.LinkSetMinMaxVfTxRate(vfDev, int(foundVf.VFNumber), uint32(0), uint32(0)); err != nil {
-			// 	log.Printf("Error setting mac address back to 0: %s\n", podInterface.HardwareAddr.String())
-			// 	return fmt.Errorf("Error setting mac address back to 0: %s\n", podInterface.HardwareAddr.String())
-			// }
 			return nil
 		})
 		if err != nil {
@@ -836,7 +931,8 @@ func releaseVFCustom(conf *NetConf, podInterface net.Interface, cid string, podN
 
 	log.Println("RIT-CNI: done")
 
-	return nil
+	// the VF is back in the host netns, the netconf is no longer needed
+	return deleteNetConf(cid, podInterface.Name, conf.CNIDir)
 }
 
 func resetVfVlan(pfName, vfName string) error {
@@ -917,82 +1013,78 @@ func getPFs(if0 string, devs []string) ([]string, error) {
 	return orderedPF, nil
 }
 
-func acquireShmMutex() (*os.File, error) {
-	log.Println("RIT-CNI: Attempting to acquire shared memory mutex.")
-	for i := 0; i < (60 * 5); i++ {
-		sharedMutex, err := shm.Open("rdma_sriov_cni", os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
-		if err != nil {
-			log.Println("RIT-CNI: Sleeping for 1 second to wait for mutex.")
-			time.Sleep(1 * time.Second)
-			continue
-		} else {
-			log.Println("RIT-CNI: Successfully acquired shared memory mutex.")
-			return sharedMutex, nil
-		}
-	}
+// cmdAdd uses a named error so that the deferred rollbacks see every
+// failure, including the ones returned directly.
+func cmdAdd(args *skel.CmdArgs) (err error) {
+	log.Println("RIT-CNI: CMDADD")
 
-	log.Println("RIT-CNI: Reached timeout waiting for shared memory mutex to become available. Assuming existing file was left by crashed program.")
-	//we reached the timeout, assume the file was left by a previous instance that crashed
-	sharedMutex, err := shm.Open("rdma_sriov_cni", os.O_RDWR|os.O_EXCL, 0600)
+	n, err := loadConf(args.StdinData)
 	if err != nil {
-		return nil, fmt.Errorf("Could not open shared mutex file after timeout: %s", err)
+		return err
 	}
 
-	log.Println("RIT-CNI: Opened existing shared memory mutex file.")
-	return sharedMutex, nil
-}
-
-func releaseShmMutex(mutexFile *os.File) error {
-	log.Println("RIT-CNI: Attempting to release shared memory mutex.")
-	defer mutexFile.Close()
-	err := shm.Unlink(mutexFile.Name())
+	lock, err := acquireNodeLock("ADD", args.ContainerID, n.lockTimeout)
 	if err != nil {
-		log.Printf("RIT-CNI: Failed to release shared memory mutex: %s", err)
-		return fmt.Errorf("Failed to release shared memory mutex: %s", err)
+		log.Printf("RIT-CNI: %s\n", err)
+		return newError(errCodeNodeLock, "unable to acquire the node lock", "%v", err)
 	}
+	defer lock.release()
 
-	log.Println("RIT-CNI: Successfully released shared memory mutex.")
-	return nil
-}
-
-func cmdAdd(args *skel.CmdArgs) error {
-	log.Println("RIT-CNI: CMDADD")
+	podArgs, err := loadPodArgs(args.Args)
+	if err != nil {
+		return err
+	}
+	if err = applyRuntimeConfig(n, podArgs); err != nil {
+		return err
+	}
+	if podArgs.VLAN.set {
+		n.Vlan = podArgs.VLAN.value
+	}
+	pod_name := string(podArgs.K8S_POD_NAME)
+	pod_ns := string(podArgs.K8S_POD_NAMESPACE)
 
-	//acquire shared memory mutex
-	shmMutexFile, err := acquireShmMutex()
+	pod_interfaces_required, err := getPodRequirements(pod_name, pod_ns)
 	if err != nil {
-		log.Println("RIT-CNI: %s", err)
-		log.Fatal("Unable to acquire shared memory mutex.")
-	}
-	defer releaseShmMutex(shmMutexFile)
-
-	pod_name := ""
-	pod_ns := ""
-	for _, arg_mapping := range strings.Split((*args).Args, ";") {
-		key_value_pair := strings.Split(arg_mapping, "=")
-		if len(key_value_pair) == 2 {
-			if key_value_pair[0] == "K8S_POD_NAMESPACE" {
-				pod_ns = key_value_pair[1]
-			} else if key_value_pair[0] == "K8S_POD_NAME" {
-				pod_name = key_value_pair[1]
-			}
-		}
+		return err
+	}
+	if err = applyBandwidth(pod_interfaces_required, n.RuntimeConfig.Bandwidth); err != nil {
+		return err
+	}
+	pfs_available, err := queryNodePFs()
+	if err != nil {
+		return newError(errCodeHardwareDaemonUnreachable, "RDMA hardware daemon unreachable",
+			"could not determine what RDMA hardware resources are available: %v", err)
 	}
 
-	pod_interfaces_required := getPodRequirements(pod_name, pod_ns)
-	pfs_available, err := rdma_hardware_info.QueryNode("127.0.0.1", rdma_hardware_info.DefaultPort, 1500)
+	// a VF handed out through deviceID pins the first pod interface
+	if err = applyDeviceID(pod_interfaces_required, n.RuntimeConfig.DeviceID); err != nil {
+		return err
+	}
+	requested_vfs, err := resolvePciAddresses(pod_interfaces_required)
 	if err != nil {
-		log.Fatal("Could not determine what RDMA hardware resources are available.")
+		return err
 	}
 
-	pod_interface_placements, placement_successful := knapsack_pod_placement.PlacePod(pod_interfaces_required, pfs_available, false)
-	if !placement_successful {
-		log.Fatal("Unable to fit pod into available RDMA resources on node.")
+	placer, err := placement.New(n.Placement)
+	if err != nil {
+		return err
+	}
+	applyTopologyHint(pod_interfaces_required, podArgs.NUMA_NODES)
+	inventory := placement.NewInventory(pfs_available).
+		WithTopology(getNodeTopology(pfs_available)).
+		WithPolicies(n.Policy, n.PFPolicies)
+	reservation, diagnosis := placement.Reserve(placer, pod_interfaces_required, inventory)
+	if reservation == nil {
+		recordPodEvent(podArgs, "RdmaPlacementFailed",
+			fmt.Sprintf("unable to fit the RDMA interfaces into the node: %s", diagnosis))
+		return newError(errCodeInsufficientRdmaResources, "insufficient RDMA bandwidth",
+			"unable to fit pod %s/%s into available RDMA resources on node: %s",
+			pod_ns, pod_name, diagnosis)
 	}
 
-	n, err := loadConf(args.StdinData)
+	vf_plan, err := planVFs(reservation.Placements, inventory.PFs(), requested_vfs)
 	if err != nil {
-		return fmt.Errorf("failed to load netconf: %v", err)
+		return err
 	}
 
 	netns, err := ns.GetNS(args.Netns)
@@ -1001,6 +1093,22 @@ func cmdAdd(args *skel.CmdArgs) error {
 	}
 	defer netns.Close()
 
+	ledger := &podLedger{
+		ContainerID:  args.ContainerID,
+		Netns:        args.Netns,
+		PodNamespace: pod_ns,
+		PodName:      pod_name,
+	}
+	// runs after the rollbacks below; VFs that could not be rolled back
+	//	stay recorded for cmdDel
+	defer func() {
+		if err != nil && len(ledger.Allocations) == 0 {
+			if removeErr := removeLedger(n.CNIDir, args.ContainerID); removeErr != nil {
+				log.Printf("RIT-CNI: %v\n", removeErr)
+			}
+		}
+	}()
+
 	old_ifname := os.Getenv("CNI_IFNAME")
 	defer os.Setenv("CNI_IFNAME", old_ifname)
 	if n.IF0NAME != "" {
@@ -1008,56 +1116,127 @@ func cmdAdd(args *skel.CmdArgs) error {
 		os.Setenv("CNI_IFNAME", args.IfName)
 	}
 
+	// when chained in a conflist, the interfaces and addresses of this
+	//	plugin are added to the result of the previous plugins
 	var finalResult *current.Result
+	if n.PrevResult != nil {
+		finalResult, err = current.GetResult(n.PrevResult)
+		if err != nil {
+			return fmt.Errorf("failed to convert prevResult: %v", err)
+		}
+	}
 
-	for iPodPlacement, podPlacement := range pod_interface_placements {
-		pf := pfs_available[podPlacement]
-
+	for iPodPlacement, assignment := range vf_plan {
 		ifName := fmt.Sprintf("eth%d", iPodPlacement)
-		var vfNum *int
-		vfNum, err = setupVF(n, pf.Name, ifName, args.ContainerID, netns, pod_interfaces_required[iPodPlacement])
+		n.MAC = ""
+		n.Sharedvf = false
+		if mac := podArgs.MAC.get(iPodPlacement); mac != nil {
+			n.MAC = mac.String()
+		}
+		pfName := assignment.PFName
+		_, err = setupVF(n, pfName, ifName, args.ContainerID, netns, pod_interfaces_required[iPodPlacement].RdmaInterfaceRequest, assignment.VF, ledger)
 		//defer func is called when errors are encountered, will rollback any changes made
+		//	to the VF setupVF recorded, wherever it got to
 		defer func(internalIfName string) {
 			if err != nil {
-				err = netns.Do(func(_ ns.NetNS) error {
-					_, err := netlink.LinkByName(internalIfName)
-					return err
-				})
-				if err == nil {
-					releaseVF(n, internalIfName, args.ContainerID, netns, pf.Name, vfNum)
+				alloc := ledger.allocation(internalIfName)
+				if alloc == nil {
+					return
+				}
+				if releaseErr := releaseAllocation(n, alloc, netns); releaseErr != nil {
+					log.Printf("RIT-CNI: failed to roll back pod interface %q: %v\n", internalIfName, releaseErr)
+					alloc.LastError = releaseErr.Error()
+				} else {
+					deleteNetConf(args.ContainerID, internalIfName, n.CNIDir)
+					ledger.forget(internalIfName)
+				}
+				if saveErr := ledger.save(n.CNIDir); saveErr != nil {
+					log.Printf("RIT-CNI: %v\n", saveErr)
 				}
 			}
 		}(ifName)
 		if err != nil {
-			return fmt.Errorf("failed to set up pod interface %q from the device %s: %v", ifName, pf.Name, err)
+			if _, ok := err.(*types.Error); ok {
+				return err
+			}
+			return fmt.Errorf("failed to set up pod interface %q from the device %s: %v", ifName, pfName, err)
 		}
 
-		// skip the IPAM allocation for the DPDK and L2 mode
-		var result *types.Result
-		if n.DPDKMode != false || n.L2Mode != false {
-			return fmt.Errorf("error setting dpdk mode: %s", result.Print())
+		//multiple interfaces are possible, so every result is merged
+		//	into a single result
+		if finalResult == nil {
+			log.Println("RIT-CNI: setting finalResult up the first time")
+			finalResult = &current.Result{
+				CNIVersion: current.ImplementedSpecVersion,
+			}
+		}
+
+		// skip the IPAM allocation for the DPDK mode, the VF is bound to
+		//	the DPDK driver and never enters the pod netns
+		if n.DPDKMode != false {
+			finalResult.Interfaces = append(finalResult.Interfaces, &current.Interface{
+				Name:       ifName,
+				Mac:        n.MAC,
+				PciID:      n.DPDKConf.PCIaddr,
+				DevicePath: n.DPDKConf.VFIODevice,
+			})
+			continue
+		}
+
+		// skip the IPAM allocation for the L2 mode, the VF is only
+		//	brought up and renamed in the pod netns
+		if n.L2Mode != false {
+			var podInterface *current.Interface
+			podInterface, err = getPodInterface(n, ifName, netns)
+			if err != nil {
+				return err
+			}
+			finalResult.Interfaces = append(finalResult.Interfaces, podInterface)
+			if n.Sharedvf {
+				podInterface, err = getPodInterface(n, ifName+"d1", netns)
+				if err != nil {
+					return err
+				}
+				finalResult.Interfaces = append(finalResult.Interfaces, podInterface)
+			}
+			continue
 		}
 
-		// run the IPAM plugin and get back the config to apply
+		// run the IPAM plugin and get back the config to apply, recording
+		//	it first so that cmdDel releases the addresses even if cmdAdd
+		//	does not get to record them
+		alloc := ledger.allocation(ifName)
+		alloc.IPAM = &ipamHandle{
+			Type:        n.IPAM.Type,
+			ContainerID: args.ContainerID,
+			IfName:      os.Getenv("CNI_IFNAME"),
+			Args:        ipamArgs(args.Args, podArgs.IP.get(iPodPlacement)),
+			Netconf:     args.StdinData,
+		}
+		if err = ledger.save(n.CNIDir); err != nil {
+			return err
+		}
+		var result *current.Result
 		log.Println("RIT-CNI: starting ipam")
-		result, err = ipam.ExecAdd(n.IPAM.Type, args.StdinData)
+		result, err = execIPAMAdd(n.IPAM.Type, args.StdinData, alloc.IPAM.Args)
 		if err != nil {
 			log.Println("RIT-CNI: error getting ipam: ", err)
 			return fmt.Errorf("failed to set up IPAM plugin type %q from the device %q: %v", n.IPAM.Type, ifName, err)
 		}
-		if result.IP4 == nil {
-			log.Println("RIT-CNI: error getting ip4 from result")
-			return errors.New("IPAM plugin returned missing IPv4 config")
+		if len(result.IPs) == 0 {
+			log.Println("RIT-CNI: error getting ip from result")
+			err = errors.New("IPAM plugin returned missing IP config")
+			return err
+		}
+		for _, ipc := range result.IPs {
+			alloc.IPAM.IPs = append(alloc.IPAM.IPs, ipc.Address.String())
+		}
+		if err = ledger.save(n.CNIDir); err != nil {
+			return err
 		}
-		defer func() {
-			if err != nil {
-				log.Println("RIT-CNI: ipam defer called")
-				ipam.ExecDel(n.IPAM.Type, args.StdinData)
-			}
-		}()
 		err = netns.Do(func(_ ns.NetNS) error {
 			log.Printf("RIT-CNI: configuring interface[%s] with ip result: %+v\n", ifName, result)
-			err := ipam.ConfigureIface(ifName, result)
+			err := configureIface(ifName, result)
 			log.Println("RIT-CNI: finished ipam with err: ", err)
 			return err
 		})
@@ -1066,91 +1245,23 @@ func cmdAdd(args *skel.CmdArgs) error {
 			log.Println("RIT-CNI: error configuring interface in device netnamespace: ", err)
 			return err
 		}
-
-		result.DNS = n.DNS
 		log.Printf("RIT-CNI: ipam successfully configured with: %+v\n", result)
 
-		//must convert 0.2.0 spec that this to 0.4.0
-		//need this b/c multiple interfaces are possible
-		var result020 *types020.Result
-		if result.IP4 != nil {
-			var routes []types040.Route
-			for _, route := range result.IP4.Routes {
-				newRoute := types040.Route{
-					Dst: route.Dst,
-					GW:  route.GW,
-				}
-				routes = append(routes, newRoute)
-			}
-			result020 = &types020.Result{
-				CNIVersion: types020.ImplementedSpecVersion,
-				IP4: &types020.IPConfig{
-					IP:      result.IP4.IP,
-					Gateway: result.IP4.Gateway,
-					Routes:  routes,
-				},
-				DNS: types040.DNS{
-					Nameservers: result.DNS.Nameservers,
-					Domain:      result.DNS.Domain,
-					Search:      result.DNS.Search,
-					Options:     result.DNS.Options,
-				},
-			}
-		} else if result.IP6 != nil {
-			//not implemented in ipam, so no need to implement it here
+		var podInterface *current.Interface
+		podInterface, err = getPodInterface(n, ifName, netns)
+		if err != nil {
+			return err
 		}
-
-		if result020 != nil {
-			log.Printf("RIT-CNI: adding result020: %+v\n", result020)
-			newResult, err := current.NewResultFromResult(result020)
-			if err != nil {
-				log.Println("RIT-CNI: Error converting to new result: ", err)
-				continue
-			}
-			if finalResult == nil {
-				log.Println("RIT-CNI: setting finalResult up the first time")
-				finalResult = newResult
-			} else {
-				log.Println("RIT-CNI: setting up ip")
-				if result020.IP4 != nil {
-					log.Println("RIT-CNI: setting up ip4")
-					log.Println("RIT-CNI: stuff", finalResult)
-					finalResult.IPs = append(finalResult.IPs, &current.IPConfig{
-						Version: "4",
-						Address: result020.IP4.IP,
-						Gateway: result020.IP4.Gateway,
-					})
-					log.Println("RIT-CNI: setting ip4 config")
-					for _, route := range result020.IP4.Routes {
-						finalResult.Routes = append(finalResult.Routes, &types040.Route{
-							Dst: route.Dst,
-							GW:  route.GW,
-						})
-					}
-					log.Println("RIT-CNI: finish setting up ip4")
-				}
-
-				if result020.IP6 != nil {
-					log.Println("RIT-CNI: setting up ip6")
-					finalResult.IPs = append(finalResult.IPs, &current.IPConfig{
-						Version: "6",
-						Address: result020.IP6.IP,
-						Gateway: result020.IP6.Gateway,
-					})
-					for _, route := range result020.IP6.Routes {
-						finalResult.Routes = append(finalResult.Routes, &types040.Route{
-							Dst: route.Dst,
-							GW:  route.GW,
-						})
-					}
-				}
-				log.Println("RIT-CNI: finished setting up ip")
-			}
-			finalResult.Interfaces = append(finalResult.Interfaces, &current.Interface{
-				Name: ifName,
-			})
-			log.Printf("RIT-CNI: finalResult current data: %+v\n", finalResult)
+		ifIndex := len(finalResult.Interfaces)
+		finalResult.Interfaces = append(finalResult.Interfaces, podInterface)
+		for _, ipc := range result.IPs {
+			ipc.Interface = current.Int(ifIndex)
+			finalResult.IPs = append(finalResult.IPs, ipc)
 		}
+		// the route object of the spec has no interface index, unlike the
+		//	IP config, so routes are passed on as the IPAM plugin gave them
+		finalResult.Routes = append(finalResult.Routes, result.Routes...)
+		log.Printf("RIT-CNI: finalResult current data: %+v\n", finalResult)
 	}
 	if finalResult == nil {
 		//if no interfaces were needed, than return initialized empty result
@@ -1158,8 +1269,11 @@ func cmdAdd(args *skel.CmdArgs) error {
 			CNIVersion: current.ImplementedSpecVersion,
 		}
 	}
+	if len(n.DNS.Nameservers) > 0 || n.DNS.Domain != "" || len(n.DNS.Search) > 0 || len(n.DNS.Options) > 0 {
+		finalResult.DNS = n.DNS
+	}
 	log.Printf("RIT-CNI: finalResult struct: %+v\n", finalResult)
-	return finalResult.Print()
+	return printResult(finalResult, n.CNIVersion)
 }
 
 func getNamespaceInterfaces(netnsName string) ([]net.Interface, error) {
@@ -1207,22 +1321,54 @@ func cmdDel(args *skel.CmdArgs) error {
 
 	log.Println("RIT-CNI: CMDDEL starting")
 
-	//acquire shared memory mutex
-	shmMutexFile, err := acquireShmMutex()
+	lock, err := acquireNodeLock("DEL", args.ContainerID, n.lockTimeout)
+	if err != nil {
+		log.Printf("RIT-CNI: %s\n", err)
+		return newError(errCodeNodeLock, "unable to acquire the node lock", "%v", err)
+	}
+	defer lock.release()
+
+	// the ledger tells which addresses and VFs to release, whether or not
+	//	the pod netns still exists
+	ledger, err := loadLedger(n.CNIDir, args.ContainerID)
+	if err != nil {
+		return err
+	}
+	if ledger != nil {
+		if err = releaseLedger(n, ledger, args.Netns); err != nil {
+			return err
+		}
+		log.Println("RIT-CNI: CMDDEL ended")
+		return nil
+	}
+
+	// pods set up before the ledger existed are known by the netconf
+	//	setupVF saved for every pod interface. Without either, an earlier
+	//	DEL released everything already or ADD never got to a VF.
+	savedConfs, err := getSavedNetConfs(args.ContainerID, n.CNIDir)
 	if err != nil {
-		log.Println("RIT-CNI: %s", err)
-		log.Fatal("Unable to acquire shared memory mutex.")
+		return err
+	}
+	if len(savedConfs) == 0 {
+		log.Printf("RIT-CNI: nothing left to release for %s\n", args.ContainerID)
+		return nil
 	}
-	defer releaseShmMutex(shmMutexFile)
 
-	// skip the IPAM release for the DPDK and L2 mode
-	if n.IPAM.Type != "" {
+	// skip the IPAM release for the DPDK and L2 mode, cmdAdd never
+	//	allocated an address for them
+	if n.IPAM.Type != "" && n.DPDKMode == false && n.L2Mode == false {
 		err = ipam.ExecDel(n.IPAM.Type, args.StdinData)
 		if err != nil {
 			return err
 		}
 	}
 
+	// DPDK VFs are bound outside of the pod netns, they are found from
+	//	the saved netconf
+	if n.DPDKMode != false {
+		return releaseDPDKVFs(n, args.ContainerID)
+	}
+
 	if args.Netns == "" {
 		return nil
 	}
@@ -1232,31 +1378,77 @@ func cmdDel(args *skel.CmdArgs) error {
 	log.Printf("RIT-CNI: ARGS: %+v\n", args)
 	interfaces, err := getNamespaceInterfaces(args.Netns)
 	if err != nil {
-		return fmt.Errorf("Error getting iterfaces: %s", err)
+		// without a ledger the VFs cannot be told apart once they are
+		//	back in the host netns
+		log.Printf("RIT-CNI: pod netns %s is gone, leaving its VFs as they are: %v\n", args.Netns, err)
+		return nil
 	}
 
-	pfs_available, err := rdma_hardware_info.QueryNode("127.0.0.1", rdma_hardware_info.DefaultPort, 1500)
+	pfs_available, err := queryNodePFs()
 	if err != nil {
-		log.Println("Error: could not determine what RDMA hardware resources are available")
+		return newError(errCodeHardwareDaemonUnreachable, "RDMA hardware daemon unreachable",
+			"could not determine what RDMA hardware resources are available: %v", err)
 	}
 
+	var failed []string
 	for _, netIntf := range interfaces {
 		log.Printf("RIT-CNI: Going through ifname: %s\n", netIntf.Name)
-		if strings.HasPrefix(netIntf.Name, "eth") {
-			_, err := strconv.Atoi(netIntf.Name[3:])
-			if err != nil {
-				continue
-			}
+		if isPodVFName(netIntf.Name) {
+			n.Sharedvf = false
 			if err = releaseVFCustom(n, netIntf, args.ContainerID, args.Netns, pfs_available); err != nil {
 				log.Printf("Error releasing vf %+v: %s", netIntf, err)
+				failed = append(failed, fmt.Sprintf("%s: %v", netIntf.Name, err))
 				continue
 			}
 		}
 	}
+	if len(failed) > 0 {
+		return fmt.Errorf("failed to release the VFs of %s: %s", args.ContainerID, strings.Join(failed, "; "))
+	}
 	log.Println("RIT-CNI: CMDDEL ended")
 	return nil
 }
 
+// releaseDPDKVFs rebinds every VF that cmdAdd bound to the DPDK driver for
+// the container to its kernel driver.
+func releaseDPDKVFs(conf *NetConf, cid string) error {
+	savedConfs, err := getSavedNetConfs(cid, conf.CNIDir)
+	if err != nil {
+		return err
+	}
+
+	var failed []string
+	for _, nf := range savedConfs {
+		if nf.DPDKMode == false {
+			continue
+		}
+		if err = releaseDPDKVF(nf); err != nil {
+			log.Printf("Error releasing DPDK vf %s: %s", nf.DPDKConf.PCIaddr, err)
+			failed = append(failed, fmt.Sprintf("%s: %v", nf.DPDKConf.Ifname, err))
+			continue
+		}
+		if err = deleteNetConf(cid, nf.DPDKConf.Ifname, conf.CNIDir); err != nil {
+			log.Printf("Error releasing DPDK vf %s: %s", nf.DPDKConf.PCIaddr, err)
+			failed = append(failed, fmt.Sprintf("%s: %v", nf.DPDKConf.Ifname, err))
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("failed to release the DPDK VFs of %s: %s", cid, strings.Join(failed, "; "))
+	}
+
+	return nil
+}
+
+// isPodVFName reports whether ifName is one of the ethN names cmdAdd
+// gives to the VFs it moves into a pod.
+func isPodVFName(ifName string) bool {
+	if !strings.HasPrefix(ifName, "eth") {
+		return false
+	}
+	_, err := strconv.Atoi(ifName[3:])
+	return err == nil
+}
+
 func renameLink(curName, newName string) error {
 	link, err := netlink.LinkByName(curName)
 	if err != nil {
@@ -1275,37 +1467,125 @@ func setUpLink(ifName string) error {
 	return netlink.LinkSetUp(link)
 }
 
-func getPodRequirements(pod_name string, pod_namespace string) []knapsack_pod_placement.RdmaInterfaceRequest {
+// newKubeClient connects to the Kubernetes API with the credentials of
+// the kubelet.
+func newKubeClient() (*kubernetes.Clientset, error) {
 	config, err := clientcmd.BuildConfigFromFlags("", "/etc/kubernetes/kubelet.conf")
 	if err != nil {
-		log.Fatal("RDMA CNI: Error building Kubernetes configuration from file /etc/kubernetes/kubelet.conf")
+		return nil, newError(errCodeKubernetesAPI, "Kubernetes API unavailable",
+			"error building Kubernetes configuration from file /etc/kubernetes/kubelet.conf: %v", err)
 	}
 
 	clientset, err := kubernetes.NewForConfig(config)
 	if err != nil {
-		log.Fatal("RDMA CNI: Error building clientset from Kubernetes config file.")
+		return nil, newError(errCodeKubernetesAPI, "Kubernetes API unavailable",
+			"error building clientset from Kubernetes config file: %v", err)
 	}
 
-	pod, err := clientset.CoreV1().Pods(pod_namespace).Get(pod_name, metav1.GetOptions{})
+	return clientset, nil
+}
+
+// recordPodEvent attaches a warning event to the pod, so that the reason
+// of a failure shows up in kubectl describe. Failing to do so is only
+// logged.
+func recordPodEvent(podArgs *PodArgs, reason string, message string) {
+	clientset, err := newKubeClient()
 	if err != nil {
-		log.Fatal("RDMA CNI: Error retrieving pod information from Kubernetes API server.")
+		log.Printf("RIT-CNI: unable to record %s event: %v\n", reason, err)
+		return
+	}
+
+	host, _ := os.Hostname()
+	now := metav1.Now()
+	event := &corev1.Event{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      fmt.Sprintf("%s.%x", podArgs.K8S_POD_NAME, now.UnixNano()),
+			Namespace: string(podArgs.K8S_POD_NAMESPACE),
+		},
+		InvolvedObject: corev1.ObjectReference{
+			Kind:      "Pod",
+			Namespace: string(podArgs.K8S_POD_NAMESPACE),
+			Name:      string(podArgs.K8S_POD_NAME),
+			UID:       k8stypes.UID(podArgs.K8S_POD_UID),
+		},
+		Reason:         reason,
+		Message:        message,
+		Type:           corev1.EventTypeWarning,
+		Source:         corev1.EventSource{Component: "rit-k8s-rdma-sriov-cni", Host: host},
+		FirstTimestamp: now,
+		LastTimestamp:  now,
+		Count:          1,
+	}
+	if _, err = clientset.CoreV1().Events(event.Namespace).Create(event); err != nil {
+		log.Printf("RIT-CNI: unable to record %s event: %v\n", reason, err)
+	}
+}
+
+func getPodRequirements(pod_name string, pod_namespace string) ([]placement.Request, error) {
+	clientset, err := newKubeClient()
+	if err != nil {
+		return nil, err
+	}
+
+	pod, err := clientset.CoreV1().Pods(pod_namespace).Get(pod_name, metav1.GetOptions{})
+	if errors2.IsNotFound(err) {
+		return nil, newError(errCodePodNotFound, "pod not found",
+			"pod %s/%s does not exist in the Kubernetes API server", pod_namespace, pod_name)
+	} else if err != nil {
+		return nil, newError(errCodeKubernetesAPI, "Kubernetes API unavailable",
+			"error retrieving pod %s/%s from Kubernetes API server: %v", pod_namespace, pod_name, err)
 	}
 
 	//if no annotation about required RDMA interfaces was present
 	if pod.ObjectMeta.Annotations["rdma_interfaces_required"] == "" {
 		//the pod does not need any RDMA interfaces
-		return []knapsack_pod_placement.RdmaInterfaceRequest{}
+		return []placement.Request{}, nil
 	}
 
-	var interfaces_needed []knapsack_pod_placement.RdmaInterfaceRequest
+	var interfaces_needed []placement.Request
 	err = json.Unmarshal([]byte(pod.ObjectMeta.Annotations["rdma_interfaces_required"]), &interfaces_needed)
 	if err != nil {
-		log.Fatal("RDMA CNI: Error unmarshalling JSON for RDMA interface requirements.")
+		return nil, newError(errCodeInvalidPodRequirements, "invalid rdma_interfaces_required annotation",
+			"error unmarshalling JSON for RDMA interface requirements of pod %s/%s: %v", pod_namespace, pod_name, err)
 	}
+	if err = placement.Validate(interfaces_needed); err != nil {
+		return nil, newError(errCodeInvalidPodRequirements, "invalid rdma_interfaces_required annotation",
+			"invalid RDMA interface requirements of pod %s/%s: %v", pod_namespace, pod_name, err)
+	}
+
+	return interfaces_needed, nil
+}
+
+// queryNodePFs asks the RDMA hardware daemon of the node for its PFs and
+// their VFs.
+var queryNodePFs = func() ([]rdma_hardware_info.PF, error) {
+	return rdma_hardware_info.QueryNode("127.0.0.1", rdma_hardware_info.DefaultPort, 1500)
+}
 
-	return interfaces_needed
+// describePFs summarizes the free VFs and bandwidth of the node's PFs for
+// error details.
+func describePFs(pfs []rdma_hardware_info.PF) string {
+	var parts []string
+	for _, pf := range pfs {
+		parts = append(parts, fmt.Sprintf("%s free_vfs=%d free_tx_rate=%d",
+			pf.Name, int(pf.CapacityVFs)-int(pf.UsedVFs), int(pf.CapacityTxRate)-int(pf.UsedTxRate)))
+	}
+	return "available: " + strings.Join(parts, ", ")
 }
 
 func main() {
-	skel.PluginMain(cmdAdd, cmdDel)
+	// the vendored skel only knows ADD and DEL
+	if len(os.Args) > 1 && os.Args[1] == "reconcile" {
+		reconcileMain(os.Args[2:])
+		return
+	}
+
+	switch os.Getenv("CNI_COMMAND") {
+	case "CHECK":
+		checkMain(cmdCheck)
+	case "VERSION":
+		versionMain()
+	default:
+		skel.PluginMain(cmdAdd, cmdDel)
+	}
 }
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/rit-k8s-rdma/rit-k8s-rdma-common/rdma_hardware_info"
+	"github.com/rit-k8s-rdma/rit-k8s-rdma-sriov-cni/sriov/placement"
+)
+
+// sysClassNetDir is where the netdevs of the PFs show up in sysfs.
+var sysClassNetDir = "/sys/class/net"
+
+// getPFTopology reads the NUMA node of the PF from sysfs. A node that
+// cannot be read is left unknown.
+func getPFTopology(pfName string) placement.Topology {
+	topology := placement.Topology{NUMANode: -1}
+	deviceDir := filepath.Join(sysClassNetDir, pfName, "device")
+
+	data, err := ioutil.ReadFile(filepath.Join(deviceDir, "numa_node"))
+	if err != nil {
+		log.Printf("RIT-CNI: unable to read the NUMA node of %s: %v\n", pfName, err)
+	} else if node, err := strconv.Atoi(strings.TrimSpace(string(data))); err == nil {
+		topology.NUMANode = node
+	}
+
+	return topology
+}
+
+// getNodeTopology returns the topology of every PF of the node.
+func getNodeTopology(pfs []rdma_hardware_info.PF) map[string]placement.Topology {
+	topology := make(map[string]placement.Topology, len(pfs))
+	for _, pf := range pfs {
+		topology[pf.Name] = getPFTopology(pf.Name)
+	}
+	return topology
+}
+
+// applyTopologyHint hands the NUMA nodes the Topology Manager aligned the
+// pod to down to every requested interface.
+func applyTopologyHint(requests []placement.Request, numaNodes []int) {
+	if len(numaNodes) == 0 {
+		return
+	}
+	for i := range requests {
+		requests[i].TopologyHint = numaNodes
+	}
+}
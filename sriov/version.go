@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	types040 "github.com/rit-k8s-rdma/rit-k8s-rdma-sriov-cni/sriov/cni/types"
+	"github.com/rit-k8s-rdma/rit-k8s-rdma-sriov-cni/sriov/cni/types/current"
+	"github.com/rit-k8s-rdma/rit-k8s-rdma-sriov-cni/sriov/cni/types/types020"
+
+	"github.com/containernetworking/cni/pkg/types"
+)
+
+// supportedVersions lists every CNI spec version the plugin can print
+// a result in; "" is the pre-0.1.0 config that carries no version.
+var supportedVersions = append(append([]string{}, types020.SupportedVersions...), current.SupportedVersions...)
+
+func isSupportedVersion(version string) bool {
+	for _, supported := range supportedVersions {
+		if version == supported {
+			return true
+		}
+	}
+	return false
+}
+
+func isVersion020(version string) bool {
+	for _, v := range types020.SupportedVersions {
+		if version == v {
+			return true
+		}
+	}
+	return false
+}
+
+func validateVersion(version string) error {
+	if !isSupportedVersion(version) {
+		return &types.Error{
+			Code:    types040.ErrIncompatibleCNIVersion,
+			Msg:     "incompatible CNI versions",
+			Details: fmt.Sprintf("config is %q, plugin supports %q", version, supportedVersions),
+		}
+	}
+	return nil
+}
+
+// versionAtLeast reports whether version is the same as or newer than
+// minVersion; "" is treated as 0.1.0.
+func versionAtLeast(version, minVersion string) bool {
+	if version == "" {
+		version = "0.1.0"
+	}
+	a := strings.Split(version, ".")
+	b := strings.Split(minVersion, ".")
+	for i := 0; i < len(a) && i < len(b); i++ {
+		x, _ := strconv.Atoi(a[i])
+		y, _ := strconv.Atoi(b[i])
+		if x != y {
+			return x > y
+		}
+	}
+	return len(a) >= len(b)
+}
+
+// parseResult decodes a result printed by a delegated plugin, using the
+// cniVersion the plugin put in it, and returns it as a current.Result.
+func parseResult(data []byte) (*current.Result, error) {
+	versioned := struct {
+		CNIVersion string `json:"cniVersion"`
+	}{}
+	if err := json.Unmarshal(data, &versioned); err != nil {
+		return nil, fmt.Errorf("failed to decode result version: %v", err)
+	}
+
+	return parseResultAsVersion(data, versioned.CNIVersion)
+}
+
+// parseResultAsVersion decodes a result of the given spec version and
+// returns it as a current.Result.
+func parseResultAsVersion(data []byte, version string) (*current.Result, error) {
+	var res types040.Result
+	var err error
+	if isVersion020(version) {
+		res, err = types020.NewResult(data)
+	} else {
+		res, err = current.NewResult(data)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode result: %v", err)
+	}
+
+	return current.NewResultFromResult(res)
+}
+
+// parsePrevResult decodes the prevResult handed to the plugin when it
+// runs inside a conflist. The prevResult is in the version of the config.
+func parsePrevResult(n *NetConf) (*current.Result, error) {
+	if n.RawPrevResult == nil {
+		return nil, nil
+	}
+
+	data, err := json.Marshal(n.RawPrevResult)
+	if err != nil {
+		return nil, fmt.Errorf("could not serialize prevResult: %v", err)
+	}
+
+	prevResult, err := parseResultAsVersion(data, n.CNIVersion)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse prevResult: %v", err)
+	}
+	n.PrevResult = prevResult
+
+	return prevResult, nil
+}
+
+// printResult prints result in the spec version the config asked for.
+func printResult(result *current.Result, version string) error {
+	// 0.2.0 results cannot express a result without addresses
+	if isVersion020(version) && len(result.IPs) == 0 {
+		return (&types020.Result{CNIVersion: version, DNS: result.DNS}).Print()
+	}
+	return types040.PrintResult(result, version)
+}
+
+// versionMain answers the VERSION command, which the vendored skel does
+// not support.
+func versionMain() {
+	info := struct {
+		CNIVersion        string   `json:"cniVersion"`
+		SupportedVersions []string `json:"supportedVersions,omitempty"`
+	}{
+		CNIVersion: current.ImplementedSpecVersion,
+	}
+	for _, version := range supportedVersions {
+		if version != "" {
+			info.SupportedVersions = append(info.SupportedVersions, version)
+		}
+	}
+
+	data, err := json.MarshalIndent(info, "", "    ")
+	if err == nil {
+		_, err = os.Stdout.Write(data)
+	}
+	if err != nil {
+		dieErr(&types.Error{Code: 100, Msg: fmt.Sprintf("error writing version info: %v", err)})
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/containernetworking/cni/pkg/types"
+
+	types040 "github.com/rit-k8s-rdma/rit-k8s-rdma-sriov-cni/sriov/cni/types"
+)
+
+func TestValidateVersion(t *testing.T) {
+	for _, version := range []string{"", "0.1.0", "0.2.0", "0.3.0", "0.3.1", "0.4.0"} {
+		if err := validateVersion(version); err != nil {
+			t.Errorf("%q: %v", version, err)
+		}
+	}
+
+	for _, version := range []string{"0.5.0", "1.0.0", "0.3"} {
+		err := validateVersion(version)
+		if cniErr, ok := err.(*types.Error); !ok || cniErr.Code != types040.ErrIncompatibleCNIVersion {
+			t.Errorf("%q: error %v, want code %d", version, err, types040.ErrIncompatibleCNIVersion)
+		}
+	}
+}
+
+func TestVersionAtLeast(t *testing.T) {
+	cases := []struct {
+		version    string
+		minVersion string
+		atLeast    bool
+	}{
+		{"", "0.1.0", true},
+		{"", "0.2.0", false},
+		{"0.2.0", "0.3.0", false},
+		{"0.3.0", "0.3.0", true},
+		{"0.3.1", "0.3.0", true},
+		{"0.4.0", "0.3.1", true},
+		{"0.10.0", "0.4.0", true},
+		{"1.0.0", "0.4.0", true},
+		{"0.4", "0.4.0", false},
+	}
+	for _, c := range cases {
+		if got := versionAtLeast(c.version, c.minVersion); got != c.atLeast {
+			t.Errorf("versionAtLeast(%q, %q) = %v, want %v", c.version, c.minVersion, got, c.atLeast)
+		}
+	}
+}
+
+func TestParseResult(t *testing.T) {
+	cases := []struct {
+		data    string
+		address string
+	}{
+		{`{"cniVersion":"0.2.0","ip4":{"ip":"10.0.0.2/24","gateway":"10.0.0.1"}}`, "10.0.0.2/24"},
+		{`{"ip4":{"ip":"10.0.0.2/24"}}`, "10.0.0.2/24"},
+		{`{"cniVersion":"0.3.1","ips":[{"version":"4","address":"10.0.0.2/24"}]}`, "10.0.0.2/24"},
+		{`{"cniVersion":"0.4.0","ips":[{"version":"6","address":"fd00::2/64"}]}`, "fd00::2/64"},
+	}
+	for _, c := range cases {
+		res, err := parseResult([]byte(c.data))
+		if err != nil {
+			t.Errorf("%s: %v", c.data, err)
+			continue
+		}
+		if len(res.IPs) != 1 || res.IPs[0].Address.String() != c.address {
+			t.Errorf("%s: addresses %v, want %s", c.data, res.IPs, c.address)
+		}
+	}
+
+	if _, err := parseResult([]byte(`{"cniVersion":`)); err == nil {
+		t.Error("parsed a truncated result")
+	}
+}
+
+func TestParsePrevResult(t *testing.T) {
+	n := &NetConf{}
+	n.CNIVersion = "0.3.1"
+	if res, err := parsePrevResult(n); res != nil || err != nil {
+		t.Errorf("no prevResult: got %v, %v", res, err)
+	}
+
+	n.RawPrevResult = map[string]interface{}{
+		"cniVersion": "0.3.1",
+		"ips":        []interface{}{map[string]interface{}{"version": "4", "address": "10.0.0.2/24"}},
+	}
+	res, err := parsePrevResult(n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.IPs) != 1 || res.IPs[0].Address.String() != "10.0.0.2/24" {
+		t.Errorf("addresses %v, want 10.0.0.2/24", res.IPs)
+	}
+	if !reflect.DeepEqual(n.PrevResult, res) {
+		t.Error("prevResult not kept in the NetConf")
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"fmt"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+	"golang.org/x/sys/unix"
+)
+
+// the vendored netlink can only set the max tx rate of a VF and does not
+// parse the vfinfo of a link, so IFLA_VF_RATE is sent and read back with
+// raw requests
+
+// setVfBandwidthLimits programs the min and max tx rate of the VF in Mbps,
+// 0 removes the limit, and reads them back from the PF to make sure the
+// NIC applied them.
+func setVfBandwidthLimits(pfName string, vf int, minTxRate uint, maxTxRate uint) error {
+	pfLink, err := netlink.LinkByName(pfName)
+	if err != nil {
+		return fmt.Errorf("failed to lookup master %q: %v", pfName, err)
+	}
+
+	if err = setVfRate(pfLink, vf, minTxRate, maxTxRate); err != nil {
+		return fmt.Errorf("failed to set min_tx_rate %d and max_tx_rate %d of vf %d on %s: %v",
+			minTxRate, maxTxRate, vf, pfName, err)
+	}
+
+	rate, err := getVfRate(pfLink, vf)
+	if err != nil {
+		return fmt.Errorf("failed to read back the rates of vf %d on %s: %v", vf, pfName, err)
+	}
+	if uint(rate.MinTxRate) != minTxRate || uint(rate.MaxTxRate) != maxTxRate {
+		return fmt.Errorf("%s refused the rates of vf %d: set min_tx_rate %d and max_tx_rate %d, got %d and %d",
+			pfName, vf, minTxRate, maxTxRate, rate.MinTxRate, rate.MaxTxRate)
+	}
+
+	return nil
+}
+
+// setVfRate is the IFLA_VF_RATE counterpart of netlink.LinkSetVfTxRate.
+// Equivalent to: `ip link set $link vf $vf min_tx_rate $min max_tx_rate $max`
+func setVfRate(pfLink netlink.Link, vf int, minTxRate uint, maxTxRate uint) error {
+	req := nl.NewNetlinkRequest(unix.RTM_SETLINK, unix.NLM_F_ACK)
+
+	msg := nl.NewIfInfomsg(unix.AF_UNSPEC)
+	msg.Index = int32(pfLink.Attrs().Index)
+	req.AddData(msg)
+
+	data := nl.NewRtAttr(unix.IFLA_VFINFO_LIST, nil)
+	info := nl.NewRtAttrChild(data, nl.IFLA_VF_INFO, nil)
+	vfmsg := nl.VfRate{
+		Vf:        uint32(vf),
+		MinTxRate: uint32(minTxRate),
+		MaxTxRate: uint32(maxTxRate),
+	}
+	nl.NewRtAttrChild(info, nl.IFLA_VF_RATE, vfmsg.Serialize())
+	req.AddData(data)
+
+	_, err := req.Execute(unix.NETLINK_ROUTE, 0)
+	return err
+}
+
+// vfConfig is what the PF reports about one of its VFs.
+type vfConfig struct {
+	VF        int
+	Vlan      int
+	MinTxRate uint
+	MaxTxRate uint
+}
+
+// getVfRate returns the rates of the VF from the vfinfo list of the PF.
+// Drivers that only report IFLA_VF_TX_RATE get it as the max tx rate.
+func getVfRate(pfLink netlink.Link, vf int) (*nl.VfRate, error) {
+	configs, err := getVfConfigs(pfLink)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, c := range configs {
+		if c.VF == vf {
+			return &nl.VfRate{Vf: uint32(vf), MinTxRate: uint32(c.MinTxRate), MaxTxRate: uint32(c.MaxTxRate)}, nil
+		}
+	}
+	return nil, fmt.Errorf("vf %d not found in the vfinfo list", vf)
+}
+
+// getVfConfigs returns the VLAN and rates of every VF of the PF.
+func getVfConfigs(pfLink netlink.Link) ([]vfConfig, error) {
+	req := nl.NewNetlinkRequest(unix.RTM_GETLINK, unix.NLM_F_ACK)
+
+	msg := nl.NewIfInfomsg(unix.AF_UNSPEC)
+	msg.Index = int32(pfLink.Attrs().Index)
+	req.AddData(msg)
+	// the kernel leaves out the vfinfo list unless asked for it
+	req.AddData(nl.NewRtAttr(unix.IFLA_EXT_MASK, nl.Uint32Attr(uint32(nl.RTEXT_FILTER_VF))))
+
+	msgs, err := req.Execute(unix.NETLINK_ROUTE, unix.RTM_NEWLINK)
+	if err != nil {
+		return nil, err
+	}
+	if len(msgs) != 1 {
+		return nil, fmt.Errorf("expected one link, got %d", len(msgs))
+	}
+
+	attrs, err := nl.ParseRouteAttr(msgs[0][unix.SizeofIfInfomsg:])
+	if err != nil {
+		return nil, err
+	}
+
+	var configs []vfConfig
+	for _, attr := range attrs {
+		if attr.Attr.Type&^nl.NLA_F_NESTED != unix.IFLA_VFINFO_LIST {
+			continue
+		}
+		vfInfos, err := nl.ParseRouteAttr(attr.Value)
+		if err != nil {
+			return nil, err
+		}
+		for _, vfInfo := range vfInfos {
+			c, err := parseVfInfo(vfInfo)
+			if err != nil {
+				return nil, err
+			}
+			if c != nil {
+				configs = append(configs, *c)
+			}
+		}
+	}
+
+	return configs, nil
+}
+
+// parseVfInfo returns nil if the vfinfo holds none of the attributes
+// that carry the VF number.
+func parseVfInfo(vfInfo syscall.NetlinkRouteAttr) (*vfConfig, error) {
+	vfAttrs, err := nl.ParseRouteAttr(vfInfo.Value)
+	if err != nil {
+		return nil, err
+	}
+
+	var c *vfConfig
+	haveRate := false
+	for _, vfAttr := range vfAttrs {
+		switch vfAttr.Attr.Type {
+		case nl.IFLA_VF_VLAN:
+			vlan := nl.DeserializeVfVlan(vfAttr.Value)
+			if c == nil {
+				c = &vfConfig{VF: int(vlan.Vf)}
+			}
+			c.Vlan = int(vlan.Vlan)
+		case nl.IFLA_VF_RATE:
+			rate := nl.DeserializeVfRate(vfAttr.Value)
+			if c == nil {
+				c = &vfConfig{VF: int(rate.Vf)}
+			}
+			c.MinTxRate, c.MaxTxRate = uint(rate.MinTxRate), uint(rate.MaxTxRate)
+			haveRate = true
+		case nl.IFLA_VF_TX_RATE:
+			// drivers that only report the legacy attribute
+			txRate := nl.DeserializeVfTxRate(vfAttr.Value)
+			if c == nil {
+				c = &vfConfig{VF: int(txRate.Vf)}
+			}
+			if !haveRate {
+				c.MaxTxRate = uint(txRate.Rate)
+			}
+		}
+	}
+
+	return c, nil
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/vishvananda/netlink/nl"
+)
+
+// parseTestVfInfo builds the IFLA_VF_INFO attribute the kernel reports for
+// a VF and parses it back the way getVfConfigs does.
+func parseTestVfInfo(t *testing.T, attrs ...nl.NetlinkRequestData) *vfConfig {
+	info := nl.NewRtAttr(nl.IFLA_VF_INFO, nil)
+	for _, attr := range attrs {
+		switch msg := attr.(type) {
+		case *nl.VfMac:
+			nl.NewRtAttrChild(info, nl.IFLA_VF_MAC, msg.Serialize())
+		case *nl.VfVlan:
+			nl.NewRtAttrChild(info, nl.IFLA_VF_VLAN, msg.Serialize())
+		case *nl.VfRate:
+			nl.NewRtAttrChild(info, nl.IFLA_VF_RATE, msg.Serialize())
+		case *nl.VfTxRate:
+			nl.NewRtAttrChild(info, nl.IFLA_VF_TX_RATE, msg.Serialize())
+		}
+	}
+
+	parsed, err := nl.ParseRouteAttr(info.Serialize())
+	if err != nil || len(parsed) != 1 {
+		t.Fatalf("parsing the vfinfo: %v, %v", parsed, err)
+	}
+	c, err := parseVfInfo(parsed[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestParseVfInfo(t *testing.T) {
+	cases := []struct {
+		name  string
+		attrs []nl.NetlinkRequestData
+		want  *vfConfig
+	}{
+		{
+			name: "vlan and rates",
+			attrs: []nl.NetlinkRequestData{
+				&nl.VfMac{Vf: 3},
+				&nl.VfVlan{Vf: 3, Vlan: 100},
+				&nl.VfTxRate{Vf: 3, Rate: 5000},
+				&nl.VfRate{Vf: 3, MinTxRate: 1000, MaxTxRate: 5000},
+			},
+			want: &vfConfig{VF: 3, Vlan: 100, MinTxRate: 1000, MaxTxRate: 5000},
+		},
+		{
+			name: "rate reported before the legacy tx rate",
+			attrs: []nl.NetlinkRequestData{
+				&nl.VfRate{Vf: 2, MinTxRate: 1000, MaxTxRate: 0},
+				&nl.VfTxRate{Vf: 2, Rate: 5000},
+			},
+			want: &vfConfig{VF: 2, MinTxRate: 1000},
+		},
+		{
+			name:  "legacy tx rate only",
+			attrs: []nl.NetlinkRequestData{&nl.VfTxRate{Vf: 1, Rate: 2000}},
+			want:  &vfConfig{VF: 1, MaxTxRate: 2000},
+		},
+		{
+			name:  "unconfigured",
+			attrs: []nl.NetlinkRequestData{&nl.VfVlan{Vf: 0}, &nl.VfRate{Vf: 0}},
+			want:  &vfConfig{VF: 0},
+		},
+		{
+			name:  "no VF number",
+			attrs: []nl.NetlinkRequestData{&nl.VfMac{Vf: 4}},
+			want:  nil,
+		},
+	}
+
+	for _, c := range cases {
+		if got := parseTestVfInfo(t, c.attrs...); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: parsed %+v, want %+v", c.name, got, c.want)
+		}
+	}
+}